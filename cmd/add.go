@@ -22,10 +22,8 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"log"
 	"os"
 	"os/user"
-	"strconv"
 
 	"github.com/spf13/viper"
 
@@ -35,6 +33,12 @@ import (
 
 var username string
 var apikey string
+var createUser bool
+var shell string
+var homeDir string
+var primaryGroup string
+var groups []string
+var addProfile string
 
 // addCmd represents the add command
 var addCmd = &cobra.Command{
@@ -43,77 +47,98 @@ var addCmd = &cobra.Command{
 	Long:  `Add a new system account (e.g root) to ServerAuth to have it's SSH Keys automatically managed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
+		account := Account{
+			Username:   username,
+			ApiKey:     apikey,
+			CreateUser: createUser,
+			Shell:      shell,
+			Home:       homeDir,
+			Group:      primaryGroup,
+			Groups:     groups,
+		}
+
 		// Check the user exists on the server
 		u, err := user.Lookup(username)
-		if err != nil {
-			color.Red("Unable to find user `%s`. Please check the username, and re-create the user on ServerAuth.", username)
+		if err != nil && !createUser {
+			color.Red("Unable to find user `%s`. Please check the username, or use --create-user to have ServerAuth create it.", username)
 			os.Exit(1)
 		}
 
-		color.Green("Found system user: %s\nSetting up ServerAuth for the account.", u.Username)
-
 		// Read in the existing accounts and get ready for adding another user
-		viper.ReadInConfig()
+		readConfig()
 
-		var accounts []Account
-		configErr := viper.UnmarshalKey("accounts", &accounts)
+		if _, profileErr := selectProfiles(addProfile); profileErr != nil {
+			color.Red("%s", profileErr.Error())
+			os.Exit(1)
+		}
 
-		if configErr != nil {
-			panic("There was a problem setting up the user account. Please try again or contact ServerAuth for assistance")
+		// A system user can only be managed by one profile
+		if claimed, _, ok := accountProfile(viper.GetViper(), username); ok {
+			if claimed == addProfile {
+				color.Green("The user %s is already configured - no changes needed.", username)
+			} else {
+				color.Red("The user %s is already managed by the %s profile.", username, claimed)
+			}
+			os.Exit(1)
+		}
+
+		server, serverErr := loadServerConfig(addProfile, false)
+		if serverErr != nil {
+			color.Red("%s", serverErr.Error())
+			os.Exit(1)
 		}
 
-		for _, data := range accounts {
-			if data.Username == username {
-				color.Green("The user %s is already configured - no changes needed.", data.Username)
+		// Check the API key with ServerAuth before changing anything on the server
+		color.Green("Validating the API key with ServerAuth.")
+		var keys string
+		resolved, keysErr := resolveAccountKey(account)
+		if keysErr == nil {
+			keys, keysErr = fetchAccountKeys(server, resolved)
+		}
+		if keysErr != nil {
+			color.Red("The API key could not be validated: %s\nNo changes have been made.", keysErr)
+			os.Exit(1)
+		}
+
+		color.Green("The API key is valid. %d SSH key(s) will be installed for %s.", countKeys(keys), username)
+
+		if u == nil {
+			// Create the user, as requested
+			color.Yellow("The system user %s does not exist. Lets create it now.", username)
+			u, err = createSystemUser(account)
+			if err != nil {
+				color.Red("Unable to create user `%s`: %s", username, err)
 				os.Exit(1)
 			}
+			account.UserCreated = true
 		}
 
-		// Append the new account and update the config
-		accounts = append(accounts, Account{username, apikey})
-		viper.Set("accounts", accounts)
-		viper.WriteConfig()
-
-		// Work out the uid and gid for chowning
-		uid, _ := strconv.Atoi(u.Uid)
-		gid, _ := strconv.Atoi(u.Gid)
-
-		// Set up our path and file vars
-		homeDir := u.HomeDir
-		keysDir := homeDir + "/.ssh"
-		keysFile := keysDir + "/authorized_keys"
-		backupKeysFile := keysDir + "/authorized_keys.bak"
-
-		// If the .ssh directory doesnt exist, create it and set it to be owned by the user
-		if _, keysDirErr := os.Stat(keysDir); os.IsNotExist(keysDirErr) {
-			color.Yellow("It looks like " + keysDir + " does not yet exist. Lets create it now.")
-			os.MkdirAll(keysDir, 0700)
-			os.Chown(keysDir, uid, gid)
-		}
+		color.Green("Found system user: %s\nSetting up ServerAuth for the account.", u.Username)
 
-		// If we find an authorized_keys file, move it to a backup location so we dont overwrite it.
-		if _, keysFileErr := os.Stat(keysFile); !os.IsNotExist(keysFileErr) {
-			// File exists, move it to its backup location
-			backupFileErr := os.Rename(keysFile, backupKeysFile)
-			if backupFileErr != nil {
-				log.Fatal(backupFileErr)
+		// Append the new account and update the config
+		writeErr := updateAccounts(addProfile, func(accounts []Account) ([]Account, error) {
+			for _, data := range accounts {
+				if data.Username == username {
+					return nil, errAccountExists
+				}
 			}
-			color.Yellow("An existing authorized_keys file was found. This has been moved to %s", backupKeysFile)
+			return append(accounts, account), nil
+		})
 
+		if writeErr != nil {
+			color.Red("Unable to save the account to the ServerAuth config: %s", writeErr)
+			if account.UserCreated && writeErr != errAccountExists {
+				removeCreatedUser(username)
+			}
+			os.Exit(1)
 		}
 
-		// Create our authorized_keys file
-		file, fileError := os.Create(keysFile)
-		if fileError != nil {
-			panic("Unable to create authorized_keys file. Please check that the user you are running the agent as has the correct privieges.")
+		// Run the first sync straight away, so the account is never left without keys
+		if installErr := installAccountKeys(server, resolved, u, keys, "add"); installErr != nil {
+			color.Red("Unable to install the SSH keys for %s: %s", u.Username, installErr)
+			os.Exit(1)
 		}
 
-		// Write the template to the file
-		file.Write(keysFileTemplate)
-
-		// Ensure the file is owned by the correct user
-		os.Chown(keysFile, uid, gid)
-
 		color.Green("The user was successfully configured and is now managed by ServerAuth.")
 	},
 }
@@ -123,9 +148,19 @@ func init() {
 
 	// User flag
 	addCmd.Flags().StringVarP(&username, "username", "u", "", "The username of the system account to add to ServerAuth")
-	addCmd.MarkFlagRequired("user")
+	addCmd.MarkFlagRequired("username")
 
 	// API Key Flag
-	addCmd.Flags().StringVarP(&apikey, "apikey", "k", "", "The unique API Key for the system account, provided when adding the account via your ServerAuth control panel.")
-	addCmd.MarkFlagRequired("api-key")
+	addCmd.Flags().StringVarP(&apikey, "apikey", "k", "", "The unique API Key for the system account, provided when adding the account via your ServerAuth control panel. A file:, env: or credential: reference can be used instead.")
+	addCmd.MarkFlagRequired("apikey")
+
+	// User creation flags
+	addCmd.Flags().BoolVar(&createUser, "create-user", false, "Create the system account if it does not already exist")
+	addCmd.Flags().StringVar(&shell, "shell", "", "The login shell for a newly created system account")
+	addCmd.Flags().StringVar(&homeDir, "home", "", "The home directory for a newly created system account")
+	addCmd.Flags().StringVar(&primaryGroup, "group", "", "The primary group for a newly created system account")
+	addCmd.Flags().StringSliceVar(&groups, "groups", nil, "Supplementary groups for a newly created system account")
+
+	// Profile flag
+	addCmd.Flags().StringVar(&addProfile, "profile", defaultProfile, "The profile whose organisation the account belongs to")
 }
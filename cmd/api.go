@@ -0,0 +1,83 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// agentVersion is the version of this agent
+const agentVersion = "2.0.0"
+
+// agentUserAgent is sent with every request to the ServerAuth API
+var agentUserAgent = "ServerAuthAgent-v" + agentVersion + ";" + runtime.GOOS
+
+// apiClient is the http client used for ServerAuth API requests
+var apiClient = &http.Client{
+	Timeout: time.Second * 10, // Maximum of 10 secs
+}
+
+// APIError is returned when the ServerAuth API responds with a non 2xx status.
+type APIError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("the ServerAuth API returned status %d for %s", e.StatusCode, e.URL)
+}
+
+// newAPIRequest creates a request to the ServerAuth API with our custom user agent set.
+func newAPIRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", agentUserAgent)
+	return req, nil
+}
+
+// apiGet fetches the given ServerAuth API url and returns the response body.
+func apiGet(url string) ([]byte, error) {
+	req, err := newAPIRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &APIError{URL: url, StatusCode: res.StatusCode}
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
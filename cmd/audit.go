@@ -0,0 +1,81 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// auditLogFile receives a JSON line for every change the agent makes on
+// behalf of an administrator
+var auditLogFile = "/var/log/serverauth/audit.log"
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Username string    `json:"username"`
+	Detail   string    `json:"detail"`
+	UID      int       `json:"uid"`
+}
+
+// writeAudit appends an entry to the audit log. Failing to write the audit
+// log is reported but never stops the command.
+func writeAudit(action, username, detail string) {
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		Username: username,
+		Detail:   detail,
+		UID:      os.Getuid(),
+	}
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		err = appendAuditLine(line)
+	}
+	if err != nil {
+		color.Red("Unable to write to the audit log %s: %s", auditLogFile, err)
+	}
+}
+
+func appendAuditLine(line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(auditLogFile), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
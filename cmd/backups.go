@@ -0,0 +1,331 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// backupIndexFile lists every authorized_keys backup, relative to stateDir
+const backupIndexFile = "backups/index.json"
+
+// defaultBackupRetain is how many backups are kept per user by default
+const defaultBackupRetain = 10
+
+// keysBackup describes a single copy of a user's authorized_keys file
+type keysBackup struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Checksum string    `json:"checksum"`
+	Size     int       `json:"size"`
+	Command  string    `json:"command"`
+
+	// Managed is set when the file backed up was already managed by
+	// ServerAuth, so it can't be the user's original keys
+	Managed bool `json:"managed,omitempty"`
+}
+
+// backupIndex is the contents of the backup index file
+type backupIndex struct {
+	Backups []keysBackup `json:"backups"`
+}
+
+// path returns where the backup's contents are stored.
+func (b keysBackup) path() string {
+	return filepath.Join(stateDir, "backups", b.ID+".keys")
+}
+
+// backupKeysFile stores a timestamped copy of the user's current
+// authorized_keys file before it is changed. Nothing is stored when there is
+// no file, or when it already matches the contents about to be written.
+func backupKeysFile(keysDir *sshDir, username, command string, replacement []byte) (*keysBackup, error) {
+	current, err := keysDir.ReadFile("authorized_keys")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if replacement != nil && bytes.Equal(current, replacement) {
+		return nil, nil
+	}
+
+	sum := sha256.Sum256(current)
+	now := time.Now().UTC()
+
+	backup := keysBackup{
+		ID:       now.Format("20060102-150405") + "-" + username + "-" + hex.EncodeToString(sum[:4]),
+		Username: username,
+		Created:  now,
+		Checksum: hex.EncodeToString(sum[:]),
+		Size:     len(current),
+		Command:  command,
+		Managed:  managedKeys(current),
+	}
+
+	unlock, err := lockState(backupIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var index backupIndex
+	if err := readState(backupIndexFile, &index); err != nil {
+		return nil, err
+	}
+
+	// The same contents backed up twice in one second is the same backup
+	for _, existing := range index.Backups {
+		if existing.Username == username && existing.ID == backup.ID {
+			return &existing, nil
+		}
+	}
+
+	if err := writeFileAtomic(backup.path(), current, 0600); err != nil {
+		return nil, err
+	}
+
+	index.Backups = append(index.Backups, backup)
+	pruneBackups(&index, username)
+
+	if err := writeState(backupIndexFile, &index); err != nil {
+		return nil, err
+	}
+
+	return &backup, nil
+}
+
+// managedKeys reports whether an authorized_keys file was written by
+// ServerAuth.
+func managedKeys(contents []byte) bool {
+	return validKeysFile(string(contents)) || bytes.Equal(contents, keysFileTemplate)
+}
+
+// originalBackup returns the position in backups of the one holding a
+// user's keys from before ServerAuth managed the account, or -1 when there
+// is none. That is the latest backup taken by `add` of a file ServerAuth
+// wasn't already managing, as an account that was removed without being
+// restored is still managed when it is added again. backups must be oldest
+// first.
+func originalBackup(backups []keysBackup, username string) int {
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Username == username && backups[i].Command == "add" && !backups[i].Managed {
+			return i
+		}
+	}
+	return -1
+}
+
+// pruneBackups drops the oldest backups for username beyond the configured
+// retention count. The original keys found by originalBackup are always
+// kept for restores.
+func pruneBackups(index *backupIndex, username string) {
+	retain := defaultBackupRetain
+	if viper.IsSet("backups.retain") {
+		retain = viper.GetInt("backups.retain")
+	}
+	if retain < 1 {
+		retain = 1
+	}
+
+	sort.SliceStable(index.Backups, func(i, j int) bool {
+		return index.Backups[i].Created.Before(index.Backups[j].Created)
+	})
+
+	count := 0
+	for _, backup := range index.Backups {
+		if backup.Username == username {
+			count++
+		}
+	}
+	original := ""
+	if i := originalBackup(index.Backups, username); i >= 0 {
+		original = index.Backups[i].ID
+	}
+
+	var kept []keysBackup
+	for _, backup := range index.Backups {
+		if backup.Username == username && backup.ID != original && count > retain {
+			os.Remove(backup.path())
+			count--
+			continue
+		}
+		kept = append(kept, backup)
+	}
+	index.Backups = kept
+}
+
+// listKeysBackups returns the backups for username, oldest first. An empty
+// username returns every backup.
+func listKeysBackups(username string) ([]keysBackup, error) {
+	var index backupIndex
+	if err := readState(backupIndexFile, &index); err != nil {
+		return nil, err
+	}
+
+	var backups []keysBackup
+	for _, backup := range index.Backups {
+		if len(username) == 0 || backup.Username == username {
+			backups = append(backups, backup)
+		}
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Created.Before(backups[j].Created)
+	})
+	return backups, nil
+}
+
+// findKeysBackup looks up a backup by its id.
+func findKeysBackup(id string) (*keysBackup, error) {
+	backups, err := listKeysBackups("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, backup := range backups {
+		if backup.ID == id {
+			return &backup, nil
+		}
+	}
+	return nil, fmt.Errorf("no backup with the id %s was found", id)
+}
+
+// readKeysBackup returns the contents of a backup after verifying its checksum.
+func readKeysBackup(backup *keysBackup) ([]byte, error) {
+	contents, err := ioutil.ReadFile(backup.path())
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(contents)
+	if hex.EncodeToString(sum[:]) != backup.Checksum {
+		return nil, fmt.Errorf("the backup %s does not match its checksum and may have been modified", backup.ID)
+	}
+	return contents, nil
+}
+
+// backupsCmd represents the backups command
+var backupsCmd = &cobra.Command{
+	Use:   "backups",
+	Short: "Manage authorized_keys backups",
+	Long:  `A copy of each authorized_keys file is kept before ServerAuth changes it. These commands list and restore those backups.`,
+}
+
+// backupsListCmd represents the backups list command
+var backupsListCmd = &cobra.Command{
+	Use:         "list",
+	Short:       "List authorized_keys backups",
+	Long:        `List the stored authorized_keys backups, optionally for a single system account.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		backups, err := listKeysBackups(username)
+		if err != nil {
+			color.Red("Unable to read the backup index: %s", err)
+			os.Exit(1)
+		}
+
+		if len(backups) == 0 {
+			color.Yellow("No backups were found.")
+			return
+		}
+
+		fmt.Printf("%-42s %-16s %-20s %-8s %-18s %s\n", "ID", "USERNAME", "CREATED", "SIZE", "COMMAND", "CHECKSUM")
+		for _, backup := range backups {
+			fmt.Printf("%-42s %-16s %-20s %-8d %-18s %s\n", backup.ID, backup.Username, backup.Created.Local().Format("2006-01-02 15:04:05"), backup.Size, backup.Command, backup.Checksum[:16])
+		}
+	},
+}
+
+// backupsRestoreCmd represents the backups restore command
+var backupsRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "Restore an authorized_keys backup",
+	Long:  `Restore an authorized_keys backup by its id. The current file is backed up first, so a restore can itself be undone.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		backup, err := findKeysBackup(args[0])
+		if err != nil {
+			color.Red("Unable to restore the backup: %s", err)
+			os.Exit(1)
+		}
+
+		contents, err := readKeysBackup(backup)
+		if err != nil {
+			color.Red("Unable to restore the backup: %s", err)
+			os.Exit(1)
+		}
+
+		u, err := user.Lookup(backup.Username)
+		if err != nil {
+			color.Red("Unable to find user `%s`.", backup.Username)
+			os.Exit(1)
+		}
+
+		keysDir, err := openSSHDir(u, true)
+		if err != nil {
+			color.Red("Unable to open the .ssh directory for %s: %s", u.Username, err)
+			os.Exit(1)
+		}
+		defer keysDir.Close()
+
+		if _, err := backupKeysFile(keysDir, u.Username, "backups restore", contents); err != nil {
+			color.Red("Unable to back up the current authorized_keys file: %s", err)
+			os.Exit(1)
+		}
+
+		if err := keysDir.WriteFile("authorized_keys", contents, 0600); err != nil {
+			color.Red("Unable to restore the backup: %s", err)
+			os.Exit(1)
+		}
+
+		color.Green("The backup %s has been restored to %s.", backup.ID, keysDir.Path("authorized_keys"))
+		if _, _, managed := accountProfile(viper.GetViper(), u.Username); managed {
+			color.Yellow("The account is still managed by ServerAuth, so the next sync will replace these keys.")
+		}
+		writeAudit("backups restore", u.Username, "restored backup "+backup.ID)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupsCmd)
+	backupsCmd.AddCommand(backupsListCmd)
+	backupsCmd.AddCommand(backupsRestoreCmd)
+
+	// User flag
+	backupsListCmd.Flags().StringVarP(&username, "username", "u", "", "Only list backups for this system account")
+}
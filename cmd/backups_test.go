@@ -0,0 +1,109 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// useTestStateDir points the agent's state at a fresh directory for the
+// rest of the test.
+func useTestStateDir(t *testing.T) {
+	t.Helper()
+	saved := stateDir
+	stateDir = t.TempDir()
+	t.Cleanup(func() { stateDir = saved })
+}
+
+// testKeysDir opens the .ssh directory of a test user holding the given
+// authorized_keys file.
+func testKeysDir(t *testing.T, keys string) *sshDir {
+	t.Helper()
+	d, err := openSSHDir(testHomeUser(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	if err := d.WriteFile("authorized_keys", []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Team keys are synced to several users at once, so the same contents are
+// often backed up for different users in the same second.
+func TestBackupKeysFileSameContentsForTwoUsers(t *testing.T) {
+	useTestStateDir(t)
+	const keys = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG team@example.com\n"
+
+	for _, username := range []string{"root", "deploy"} {
+		backup, err := backupKeysFile(testKeysDir(t, keys), username, "sync", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backup == nil || backup.Username != username {
+			t.Fatalf("backupKeysFile() for %s = %+v", username, backup)
+		}
+	}
+
+	for _, username := range []string{"root", "deploy"} {
+		backups, err := listKeysBackups(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != 1 {
+			t.Errorf("%s has %d backups, want 1", username, len(backups))
+		}
+	}
+}
+
+// Adding an account again after it was removed without --restore backs up
+// a file ServerAuth already manages, which must not replace the original.
+func TestOriginalBackupSurvivesReAdd(t *testing.T) {
+	useTestStateDir(t)
+	viper.Set("backups.retain", 1)
+	defer viper.Set("backups.retain", nil)
+
+	const original = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ alice@laptop\n"
+	if _, err := backupKeysFile(testKeysDir(t, original), "alice", "add", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d := testKeysDir(t, "### START ServerAuth Managed Keys File ###\n### END ServerAuth Managed Keys File ###\n")
+	if _, err := backupKeysFile(d, "alice", "add", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backupKeysFile(d, "alice", "sync", []byte("replacement\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _, err := originalKeys(d, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != original {
+		t.Errorf("originalKeys() = %q, want %q", contents, original)
+	}
+}
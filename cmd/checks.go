@@ -0,0 +1,328 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/spf13/viper"
+)
+
+// defaultCheckTimeout matches the default of the Nagios plugins
+const defaultCheckTimeout = 10 * time.Second
+
+// maxCheckOutput is as much of a plugin's output as is read
+const maxCheckOutput = 64 * 1024
+
+// checkDefinition is a single check under monitor.checks
+type checkDefinition struct {
+	Name    string
+	Command string
+	Timeout string
+}
+
+// timeout returns how long the check may run for.
+func (c checkDefinition) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultCheckTimeout
+}
+
+// loadChecks reads the checks from the config.
+func loadChecks() ([]checkDefinition, error) {
+	var checks []checkDefinition
+	err := viper.UnmarshalKey("monitor.checks", &checks)
+	return checks, err
+}
+
+// checksCollector runs the Nagios compatible check plugins listed under
+// monitor.checks, all at the same time
+type checksCollector struct{}
+
+func (checksCollector) Name() string { return "checks" }
+
+// DefaultTimeout gives every check long enough to reach its own timeout.
+func (checksCollector) DefaultTimeout() time.Duration {
+	longest := time.Duration(0)
+	checks, _ := loadChecks()
+	for _, check := range checks {
+		if check.timeout() > longest {
+			longest = check.timeout()
+		}
+	}
+	return longest + time.Second
+}
+
+func (checksCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	checks, err := loadChecks()
+	if err != nil {
+		return err
+	}
+
+	results := make([]metrics.Check, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check checkDefinition) {
+			defer wg.Done()
+			results[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	p.Checks = results
+	return nil
+}
+
+// runCheck runs a check plugin with the shell, and reads its status from the
+// exit code and its message and perfdata from the output. A plugin that runs
+// out of time is killed along with anything it started.
+func runCheck(ctx context.Context, check checkDefinition) metrics.Check {
+	result := metrics.Check{Name: check.Name, Status: metrics.CheckUnknown, ExitCode: 3}
+
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+
+	output := &limitedBuffer{limit: maxCheckOutput}
+	errOutput := &limitedBuffer{limit: maxCheckOutput}
+	cmd := exec.Command("/bin/sh", "-c", check.Command)
+	cmd.Dir = "/"
+	cmd.Stdout = output
+	cmd.Stderr = errOutput
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		result.Output = fmt.Sprintf("unable to run the check: %v", err)
+		return result
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		result.DurationMilliseconds = float64(time.Since(start)) / float64(time.Millisecond)
+		result.Output = fmt.Sprintf("the check timed out after %s", check.timeout())
+		return result
+	}
+	result.DurationMilliseconds = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			result.Output = fmt.Sprintf("unable to run the check: %v", err)
+			return result
+		}
+		result.ExitCode = exitErr.ExitCode()
+	} else {
+		result.ExitCode = 0
+	}
+
+	switch result.ExitCode {
+	case 0:
+		result.Status = metrics.CheckOK
+	case 1:
+		result.Status = metrics.CheckWarning
+	case 2:
+		result.Status = metrics.CheckCritical
+	default:
+		result.Status = metrics.CheckUnknown
+	}
+
+	result.Output, result.Perfdata = parsePluginOutput(output.String())
+
+	// Plugins that fail to start, e.g. with a missing library, only explain
+	// why on stderr
+	if len(result.Output) == 0 && len(result.Perfdata) == 0 {
+		result.Output, _ = parsePluginOutput(errOutput.String())
+	}
+	return result
+}
+
+// parsePluginOutput splits the output of a plugin into the first line of
+// text and the perfdata. Perfdata follows a | on the first line, and on the
+// first line of the long text that has one, carrying on to the end:
+//
+//	DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968
+//	/ 15272 MB (77%);
+//	/boot 68 MB (69%); | /boot=68MB;88;93;0;98
+//	/home=69357MB;253404;253409;0;253414
+func parsePluginOutput(output string) (string, []metrics.Perfdata) {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+
+	text := lines[0]
+	var perfdata []string
+	if i := strings.Index(text, "|"); i >= 0 {
+		perfdata = append(perfdata, text[i+1:])
+		text = text[:i]
+	}
+
+	inPerfdata := false
+	for _, line := range lines[1:] {
+		if inPerfdata {
+			perfdata = append(perfdata, line)
+		} else if i := strings.Index(line, "|"); i >= 0 {
+			perfdata = append(perfdata, line[i+1:])
+			inPerfdata = true
+		}
+	}
+
+	return strings.TrimSpace(text), parsePerfdata(strings.Join(perfdata, " "))
+}
+
+// perfdataValue matches a perfdata value and its unit, e.g. 2643MB or 0.5s
+var perfdataValue = regexp.MustCompile(`^([-+]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)([a-zA-Z%]*)$`)
+
+// parsePerfdata parses space separated perfdata in the plugin format
+// 'label'=value[unit];[warn];[crit];[min];[max]. Labels with spaces are
+// quoted, and a quote inside a label is doubled. Anything that can't be
+// parsed is skipped.
+func parsePerfdata(s string) []metrics.Perfdata {
+	var result []metrics.Perfdata
+
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if len(s) == 0 {
+			return result
+		}
+
+		var label string
+		if s[0] == '\'' {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] != '\'' {
+					b.WriteByte(s[i])
+					continue
+				}
+				if i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			// An unterminated label means the rest can't be trusted
+			if i+1 >= len(s) || s[i+1] != '=' {
+				return result
+			}
+			label, s = b.String(), s[i+2:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			eq := strings.IndexByte(s[:end], '=')
+			if eq <= 0 {
+				s = s[end:]
+				continue
+			}
+			label, s = s[:eq], s[eq+1:]
+		}
+
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		if perf, ok := parsePerfdataValue(label, s[:end]); ok {
+			result = append(result, perf)
+		}
+		s = s[end:]
+	}
+}
+
+// parsePerfdataValue parses the value[unit];[warn];[crit];[min];[max] part
+// of a perfdata entry.
+func parsePerfdataValue(label, value string) (metrics.Perfdata, bool) {
+	perf := metrics.Perfdata{Label: label}
+	fields := strings.Split(value, ";")
+
+	// Some plugins use a comma as the decimal separator
+	number := func(s string) *float64 {
+		f, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+		if err != nil {
+			return nil
+		}
+		return &f
+	}
+
+	if fields[0] != "U" {
+		match := perfdataValue.FindStringSubmatch(strings.Replace(fields[0], ",", ".", 1))
+		if match == nil {
+			return perf, false
+		}
+		perf.Value = number(match[1])
+		perf.Unit = match[2]
+	}
+
+	if len(fields) > 1 {
+		perf.Warning = fields[1]
+	}
+	if len(fields) > 2 {
+		perf.Critical = fields[2]
+	}
+	if len(fields) > 3 {
+		perf.Min = number(fields[3])
+	}
+	if len(fields) > 4 {
+		perf.Max = number(fields[4])
+	}
+
+	return perf, true
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and quietly
+// drops the rest so the plugin isn't killed by a closed pipe
+type limitedBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room > 0 {
+		if len(p) > room {
+			b.buf = append(b.buf, p[:room]...)
+		} else {
+			b.buf = append(b.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return string(b.buf)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+)
+
+// float returns a pointer to f, for the optional perfdata numbers.
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestParsePerfdata(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []metrics.Perfdata
+	}{
+		{
+			name: "every field",
+			data: "/=2643MB;5948;5958;0;5968",
+			want: []metrics.Perfdata{
+				{Label: "/", Value: float(2643), Unit: "MB", Warning: "5948", Critical: "5958", Min: float(0), Max: float(5968)},
+			},
+		},
+		{
+			name: "several entries",
+			data: "time=0.012s;;;0.000000 size=1024B;;;0",
+			want: []metrics.Perfdata{
+				{Label: "time", Value: float(0.012), Unit: "s", Min: float(0)},
+				{Label: "size", Value: float(1024), Unit: "B", Min: float(0)},
+			},
+		},
+		{
+			name: "missing min and max",
+			data: "load1=0.52;5.0;10.0 users=3",
+			want: []metrics.Perfdata{
+				{Label: "load1", Value: float(0.52), Warning: "5.0", Critical: "10.0"},
+				{Label: "users", Value: float(3)},
+			},
+		},
+		{
+			name: "empty thresholds with min and max",
+			data: "rta=0.5ms;;;0;",
+			want: []metrics.Perfdata{
+				{Label: "rta", Value: float(0.5), Unit: "ms", Min: float(0)},
+			},
+		},
+		{
+			name: "threshold ranges",
+			data: "temp=21.5;@10:20;~:30",
+			want: []metrics.Perfdata{
+				{Label: "temp", Value: float(21.5), Warning: "@10:20", Critical: "~:30"},
+			},
+		},
+		{
+			name: "unknown value",
+			data: "queue=U;10;20;0;100",
+			want: []metrics.Perfdata{
+				{Label: "queue", Warning: "10", Critical: "20", Min: float(0), Max: float(100)},
+			},
+		},
+		{
+			name: "quoted labels with spaces",
+			data: "'free space /var'=56%;20;10 'user''s files'=12c",
+			want: []metrics.Perfdata{
+				{Label: "free space /var", Value: float(56), Unit: "%", Warning: "20", Critical: "10"},
+				{Label: "user's files", Value: float(12), Unit: "c"},
+			},
+		},
+		{
+			name: "comma decimal separator",
+			data: "load=0,75;1,5",
+			want: []metrics.Perfdata{
+				{Label: "load", Value: float(0.75), Warning: "1,5"},
+			},
+		},
+		{
+			name: "negative and exponent values",
+			data: "offset=-0.25s bytes=1.5e3B",
+			want: []metrics.Perfdata{
+				{Label: "offset", Value: float(-0.25), Unit: "s"},
+				{Label: "bytes", Value: float(1500), Unit: "B"},
+			},
+		},
+		{
+			name: "entries that can't be parsed are skipped",
+			data: "garbage =1 a=fast b=2",
+			want: []metrics.Perfdata{
+				{Label: "b", Value: float(2)},
+			},
+		},
+		{
+			name: "unterminated quoted label",
+			data: "a=1 'broken=2 c=3",
+			want: []metrics.Perfdata{
+				{Label: "a", Value: float(1)},
+			},
+		},
+		{
+			name: "empty",
+			data: "  ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePerfdata(tt.data)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePerfdata(%q) =\n%s\nwant\n%s", tt.data, formatPerfdata(got), formatPerfdata(tt.want))
+			}
+		})
+	}
+}
+
+func TestParsePluginOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		text     string
+		perfdata []metrics.Perfdata
+	}{
+		{
+			name:   "text only",
+			output: "PROCS OK: 112 processes\n",
+			text:   "PROCS OK: 112 processes",
+		},
+		{
+			name:   "perfdata on the first line",
+			output: "PING OK - Packet loss = 0%, RTA = 0.80 ms | rta=0.800000ms;100;500;0 pl=0%;20;60;0\n",
+			text:   "PING OK - Packet loss = 0%, RTA = 0.80 ms",
+			perfdata: []metrics.Perfdata{
+				{Label: "rta", Value: float(0.8), Unit: "ms", Warning: "100", Critical: "500", Min: float(0)},
+				{Label: "pl", Value: float(0), Unit: "%", Warning: "20", Critical: "60", Min: float(0)},
+			},
+		},
+		{
+			name: "perfdata in the long text",
+			output: "DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n" +
+				"/ 15272 MB (77%);\n" +
+				"/boot 68 MB (69%); | /boot=68MB;88;93;0;98\n" +
+				"/home=69357MB;253404;253409;0;253414\n",
+			text: "DISK OK - free space: / 3326 MB (56%);",
+			perfdata: []metrics.Perfdata{
+				{Label: "/", Value: float(2643), Unit: "MB", Warning: "5948", Critical: "5958", Min: float(0), Max: float(5968)},
+				{Label: "/boot", Value: float(68), Unit: "MB", Warning: "88", Critical: "93", Min: float(0), Max: float(98)},
+				{Label: "/home", Value: float(69357), Unit: "MB", Warning: "253404", Critical: "253409", Min: float(0), Max: float(253414)},
+			},
+		},
+		{
+			name: "perfdata only in the long text",
+			output: "HTTP OK\n" +
+				"Response headers follow\n" +
+				"Server: nginx | time=0.05s size=512B\n",
+			text: "HTTP OK",
+			perfdata: []metrics.Perfdata{
+				{Label: "time", Value: float(0.05), Unit: "s"},
+				{Label: "size", Value: float(512), Unit: "B"},
+			},
+		},
+		{
+			name: "second | in the long text",
+			output: "OK - all good | a=1\n" +
+				"details\n" +
+				"more details | b=2\n" +
+				"c=3 | d=4\n",
+			text: "OK - all good",
+			perfdata: []metrics.Perfdata{
+				{Label: "a", Value: float(1)},
+				{Label: "b", Value: float(2)},
+				{Label: "c", Value: float(3)},
+				{Label: "d", Value: float(4)},
+			},
+		},
+		{
+			name:   "quoted label on the first line",
+			output: "OK | 'free space'=10GB;;;0",
+			text:   "OK",
+			perfdata: []metrics.Perfdata{
+				{Label: "free space", Value: float(10), Unit: "GB", Min: float(0)},
+			},
+		},
+		{
+			name:   "empty output",
+			output: "",
+			text:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, perfdata := parsePluginOutput(tt.output)
+			if text != tt.text {
+				t.Errorf("parsePluginOutput() text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(perfdata, tt.perfdata) {
+				t.Errorf("parsePluginOutput() perfdata =\n%s\nwant\n%s", formatPerfdata(perfdata), formatPerfdata(tt.perfdata))
+			}
+		})
+	}
+}
+
+// formatPerfdata shows perfdata with the values its pointers refer to.
+func formatPerfdata(list []metrics.Perfdata) string {
+	var s string
+	for _, perf := range list {
+		s += fmt.Sprintf("  %q value=%s unit=%q warning=%q critical=%q min=%s max=%s\n",
+			perf.Label, formatOptional(perf.Value), perf.Unit, perf.Warning, perf.Critical, formatOptional(perf.Min), formatOptional(perf.Max))
+	}
+	return s
+}
+
+// formatOptional shows an optional perfdata number.
+func formatOptional(f *float64) string {
+	if f == nil {
+		return "none"
+	}
+	return fmt.Sprint(*f)
+}
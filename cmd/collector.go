@@ -0,0 +1,234 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/spf13/viper"
+)
+
+// defaultCollectorTimeout is how long a collector may take, unless its
+// timeout setting says otherwise
+const defaultCollectorTimeout = 5 * time.Second
+
+// Collector gathers a single group of metrics for the monitoring payload
+type Collector interface {
+	// Name identifies the collector under monitor.collectors and in errors
+	Name() string
+
+	// Collect adds the collector's metrics to the payload, giving up when ctx
+	// is done. Each collector is given a payload of its own, which is merged
+	// with the others once it returns. Changes to state files are recorded
+	// in state rather than written.
+	Collect(ctx context.Context, p *metrics.Payload, state collectorState) error
+}
+
+// collectorState holds the state files collectors have changed, such as the
+// counters the next run works out rates from, by name. They are only saved
+// for collectors that finished in time, as one that is given up on may still
+// be running.
+type collectorState map[string]interface{}
+
+// save writes every state file that has been changed.
+func (s collectorState) save() error {
+	for name, v := range s {
+		if err := writeState(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tunableCollector is a collector with settings of its own, alongside
+// enabled and timeout, under monitor.collectors.<name>
+type tunableCollector interface {
+	Collector
+	Settings() map[string]*schemaField
+}
+
+// slowCollector is a collector that usually needs longer than
+// defaultCollectorTimeout
+type slowCollector interface {
+	Collector
+	DefaultTimeout() time.Duration
+}
+
+// collectors is every collector the agent has, in the order their errors
+// are reported
+var collectors = []Collector{
+	hostCollector{},
+	timeCollector{},
+	cpuCollector{},
+	memoryCollector{},
+	loadCollector{},
+	diskCollector{},
+	networkCollector{},
+	checksCollector{},
+	servicesCollector{},
+	processesCollector{},
+	loginsCollector{},
+}
+
+// collectorKey returns the config key for a setting of a collector.
+func collectorKey(name, key string) string {
+	return "monitor.collectors." + name + "." + key
+}
+
+// collectorEnabled reports whether a collector should run. Every collector
+// runs unless it is turned off.
+func collectorEnabled(c Collector) bool {
+	key := collectorKey(c.Name(), "enabled")
+	return !viper.IsSet(key) || viper.GetBool(key)
+}
+
+// collectorTimeout returns how long a collector may take.
+func collectorTimeout(c Collector) time.Duration {
+	if timeout, err := time.ParseDuration(viper.GetString(collectorKey(c.Name(), "timeout"))); err == nil && timeout > 0 {
+		return timeout
+	}
+	if slow, ok := c.(slowCollector); ok && slow.DefaultTimeout() > defaultCollectorTimeout {
+		return slow.DefaultTimeout()
+	}
+	return defaultCollectorTimeout
+}
+
+// runCollectors runs every enabled collector at the same time and merges
+// their metrics into the payload. The error from each collector that failed
+// or ran out of time is recorded in the payload. The state changed by the
+// collectors that finished is returned for the caller to save.
+func runCollectors(p *metrics.Payload) collectorState {
+	var enabled []Collector
+	for _, c := range collectors {
+		if collectorEnabled(c) {
+			enabled = append(enabled, c)
+		}
+	}
+
+	partials := make([]*metrics.Payload, len(enabled))
+	states := make([]collectorState, len(enabled))
+	errs := make([]error, len(enabled))
+
+	var wg sync.WaitGroup
+	for i, c := range enabled {
+		wg.Add(1)
+		go func(i int, c Collector) {
+			defer wg.Done()
+			partials[i], states[i], errs[i] = runCollector(c, p.CollectedAt)
+		}(i, c)
+	}
+	wg.Wait()
+
+	state := collectorState{}
+	for i, c := range enabled {
+		if partials[i] != nil {
+			mergePayload(p, partials[i])
+		}
+		for name, v := range states[i] {
+			state[name] = v
+		}
+		if errs[i] != nil {
+			if p.Errors == nil {
+				p.Errors = map[string]string{}
+			}
+			p.Errors[c.Name()] = errs[i].Error()
+		}
+	}
+
+	return state
+}
+
+// runCollector runs a single collector with its timeout. Nothing is returned
+// from a collector that runs out of time, as it may still be writing to its
+// payload and state.
+func runCollector(c Collector, collectedAt time.Time) (*metrics.Payload, collectorState, error) {
+	timeout := collectorTimeout(c)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	partial := metrics.New(collectedAt)
+	state := collectorState{}
+	done := make(chan error, 1)
+
+	go func() {
+		// A bug in one collector shouldn't stop the others being sent
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("the collector crashed: %v", r)
+			}
+		}()
+		done <- c.Collect(ctx, partial, state)
+	}()
+
+	select {
+	case err := <-done:
+		return partial, state, err
+	case <-ctx.Done():
+		return nil, nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// mergePayload copies every group of metrics that src has into dst.
+// Collectors fill in different groups, except that lists such as checks can
+// be added to by more than one, so lists are appended to rather than
+// replaced.
+func mergePayload(dst, src *metrics.Payload) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		switch d.Type().Field(i).Name {
+		case "SchemaVersion", "CollectedAt", "Agent", "Host", "Errors":
+			continue
+		}
+		switch {
+		case s.Field(i).IsZero():
+		case s.Field(i).Kind() == reflect.Slice:
+			d.Field(i).Set(reflect.AppendSlice(d.Field(i), s.Field(i)))
+		default:
+			d.Field(i).Set(s.Field(i))
+		}
+	}
+}
+
+// collectorSchema describes the monitor.collectors settings of every
+// collector.
+func collectorSchema() *schemaField {
+	schema := &schemaField{Kind: kindMap, Fields: map[string]*schemaField{}}
+	for _, c := range collectors {
+		fields := map[string]*schemaField{
+			"enabled": {Kind: kindBool},
+			"timeout": {Kind: kindString, Check: checkDuration},
+		}
+		if tunable, ok := c.(tunableCollector); ok {
+			for name, field := range tunable.Settings() {
+				fields[name] = field
+			}
+		}
+		schema.Fields[c.Name()] = &schemaField{Kind: kindMap, Fields: fields}
+	}
+	return schema
+}
@@ -0,0 +1,73 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/spf13/viper"
+)
+
+// stateTestCollector records a state change once its delay has passed,
+// whether or not it has been given up on.
+type stateTestCollector struct {
+	delay    time.Duration
+	recorded chan struct{}
+}
+
+func (stateTestCollector) Name() string { return "statetest" }
+
+func (c stateTestCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	time.Sleep(c.delay)
+	state["statetest.json"] = c.delay.String()
+	close(c.recorded)
+	return nil
+}
+
+func TestRunCollectorState(t *testing.T) {
+	viper.Set(collectorKey("statetest", "timeout"), "50ms")
+	defer viper.Set(collectorKey("statetest", "timeout"), nil)
+
+	c := stateTestCollector{recorded: make(chan struct{})}
+	_, state, err := runCollector(c, time.Now())
+	if err != nil {
+		t.Fatalf("runCollector() error = %v", err)
+	}
+	if state["statetest.json"] != "0s" {
+		t.Errorf("runCollector() state = %v, want the collector's changes", state)
+	}
+
+	// A collector that is given up on may still record changes, which must
+	// not be returned
+	c = stateTestCollector{delay: 200 * time.Millisecond, recorded: make(chan struct{})}
+	partial, state, err := runCollector(c, time.Now())
+	if err == nil {
+		t.Fatal("runCollector() expected a timeout error")
+	}
+	if partial != nil || state != nil {
+		t.Errorf("runCollector() returned %v and %v from a collector that timed out", partial, state)
+	}
+	<-c.recorded
+}
@@ -0,0 +1,385 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// defaultBaseDomain is used when the config does not override basedomain
+const defaultBaseDomain = "https://api.serverauth.com/"
+
+// defaultConfigFile is used when no config file has been found or given
+const defaultConfigFile = "/etc/serverauth/config.yaml"
+
+// defaultProfile is the profile made up of the top level settings
+const defaultProfile = "default"
+
+// errAccountExists is returned when adding an account that is already configured
+var errAccountExists = errors.New("the account is already configured")
+
+// serverConfig holds the organisation credentials used to talk to the API
+type serverConfig struct {
+	Profile      string
+	OrgID        string
+	ServerAPIKey string
+	TeamAPIKey   string
+	BaseDomain   string
+
+	// TeamKeyErr is why the team key couldn't be loaded, when it wasn't
+	// required
+	TeamKeyErr error
+}
+
+// keysURL returns the API url for an account's authorized_keys file.
+func (s serverConfig) keysURL(account Account) string {
+	return s.BaseDomain + "keys/" + s.OrgID + "/" + s.ServerAPIKey + "/" + account.ApiKey
+}
+
+// sudoURL returns the API url for an account's sudo policy.
+func (s serverConfig) sudoURL(account Account) string {
+	return s.BaseDomain + "sudo/" + s.OrgID + "/" + s.ServerAPIKey + "/" + account.ApiKey
+}
+
+// profileKey returns the config key for a setting in the given profile. The
+// default profile's settings live at the top level of the config, and every
+// other profile's under profiles.<name>.
+func profileKey(profile, key string) string {
+	if profile == defaultProfile {
+		return key
+	}
+	return "profiles." + profile + "." + key
+}
+
+// profileNames returns every profile in the config, default first. The
+// default profile is left out when only named profiles have been set up.
+func profileNames(v *viper.Viper) []string {
+	var named []string
+	for name := range v.GetStringMap("profiles") {
+		named = append(named, name)
+	}
+	sort.Strings(named)
+
+	if len(named) > 0 && !v.IsSet("orgid") && !v.IsSet("apikey") && !v.IsSet("accounts") {
+		return named
+	}
+	return append([]string{defaultProfile}, named...)
+}
+
+// selectProfiles returns the profile to work on, or every profile when none
+// was given.
+func selectProfiles(profile string) ([]string, error) {
+	names := profileNames(viper.GetViper())
+	if len(profile) == 0 {
+		return names, nil
+	}
+
+	for _, name := range names {
+		if name == profile {
+			return []string{profile}, nil
+		}
+	}
+	return nil, fmt.Errorf("the profile %s is not in the ServerAuth configuration", profile)
+}
+
+// profileAccounts returns the accounts configured in a profile.
+func profileAccounts(v *viper.Viper, profile string) ([]Account, error) {
+	var accounts []Account
+	if err := v.UnmarshalKey(profileKey(profile, "accounts"), &accounts); err != nil {
+		return nil, fmt.Errorf("the accounts list in the config is invalid: %v", err)
+	}
+	return accounts, nil
+}
+
+// accountProfile returns the profile that manages the system user, if any.
+func accountProfile(v *viper.Viper, username string) (string, Account, bool) {
+	for _, profile := range profileNames(v) {
+		accounts, _ := profileAccounts(v, profile)
+		for _, account := range accounts {
+			if account.Username == username {
+				return profile, account, true
+			}
+		}
+	}
+	return "", Account{}, false
+}
+
+// loadServerConfig reads a profile's organisation credentials from the
+// config. The team key is only needed for monitoring, so it is only checked
+// on request.
+func loadServerConfig(profile string, requireTeamKey bool) (serverConfig, error) {
+	server := serverConfig{Profile: profile}
+
+	// Name the profile in errors when there is more than one
+	in := ""
+	if profile != defaultProfile {
+		in = " for the " + profile + " profile"
+	}
+
+	// Get the organisation id
+	viper.UnmarshalKey(profileKey(profile, "orgid"), &server.OrgID)
+
+	if len(server.OrgID) <= 0 {
+		return server, fmt.Errorf("The organisation id%s is missing from your ServerAuth configuration.\nPlease check you've correctly configured ServerAuth on this server and try again.", in)
+	}
+
+	// Get the server api key, which may be a reference to a secret
+	viper.UnmarshalKey(profileKey(profile, "apikey"), &server.ServerAPIKey)
+
+	if len(server.ServerAPIKey) <= 0 {
+		return server, fmt.Errorf("The server API key%s is missing.\nPlease check you've correctly configured ServerAuth on this server and try again.", in)
+	}
+
+	var err error
+	if server.ServerAPIKey, err = resolveSecret(server.ServerAPIKey); err != nil {
+		return server, fmt.Errorf("The server API key%s could not be loaded: %v", in, err)
+	}
+
+	// Get the team api key
+	viper.UnmarshalKey(profileKey(profile, "teamkey"), &server.TeamAPIKey)
+
+	if requireTeamKey && len(server.TeamAPIKey) <= 0 {
+		return server, fmt.Errorf("The team API key%s is missing.\nPlease check you've correctly configured ServerAuth on this server and try again.", in)
+	}
+
+	if server.TeamAPIKey, err = resolveSecret(server.TeamAPIKey); err != nil {
+		if requireTeamKey {
+			return server, fmt.Errorf("The team API key%s could not be loaded: %v", in, err)
+		}
+		server.TeamKeyErr = fmt.Errorf("The team API key%s could not be loaded, so monitoring will fail: %v", in, err)
+	}
+
+	// Get the base domain, which can optionally be overridden
+	viper.UnmarshalKey(profileKey(profile, "basedomain"), &server.BaseDomain)
+
+	if len(server.BaseDomain) <= 0 {
+		// No overridden base domain, fall back to the default
+		server.BaseDomain = defaultBaseDomain
+	}
+
+	return server, nil
+}
+
+// readConfig reads the main config file, then merges any drop-in files from
+// the conf.d directory next to it in name order, so later files override
+// earlier ones. A missing main config file is not an error.
+func readConfig() error {
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	dropIns, err := configDropIns(configFile())
+	if err != nil {
+		return err
+	}
+
+	for _, dropIn := range dropIns {
+		f, err := os.Open(dropIn)
+		if err != nil {
+			return err
+		}
+
+		err = viper.MergeConfig(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %v", dropIn, err)
+		}
+	}
+
+	return nil
+}
+
+// configDropIns returns the drop-in files for a main config file, in the
+// order they are merged.
+func configDropIns(path string) ([]string, error) {
+	dropIns, err := filepath.Glob(filepath.Join(filepath.Dir(path), "conf.d", "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dropIns)
+	return dropIns, nil
+}
+
+// resolveAccountKey returns a copy of the account with its API key resolved,
+// for when the config holds a reference rather than the key itself.
+func resolveAccountKey(account Account) (Account, error) {
+	key, err := resolveSecret(account.ApiKey)
+	if err != nil {
+		return account, fmt.Errorf("the API key for %s could not be loaded: %v", account.Username, err)
+	}
+
+	account.ApiKey = key
+	return account, nil
+}
+
+// configFile returns the path of the config file that changes are written to.
+func configFile() string {
+	if used := viper.ConfigFileUsed(); len(used) > 0 {
+		return used
+	}
+	return defaultConfigFile
+}
+
+// lockConfig runs fn while holding an exclusive lock on the config file, so
+// parallel runs of the agent never lose each other's changes.
+func lockConfig(fn func(path string) error) error {
+	path := configFile()
+
+	// On a new server the config directory, where the lock lives, doesn't
+	// exist until the first config is written
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to create the config directory: %v", err)
+	}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open the config lock: %v", err)
+	}
+	defer lock.Close()
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock the config file: %v", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	return fn(path)
+}
+
+// skipConfigValidation is set as an annotation on commands that must work
+// without a valid config, e.g. because they create it or only read state
+const skipConfigValidation = "skipConfigValidation"
+
+// checkConfig validates the config before a command runs, printing every
+// problem found and exiting rather than failing part way through.
+func checkConfig(cmd *cobra.Command, args []string) {
+	if skipsConfigCheck(cmd) {
+		return
+	}
+
+	readErr := readConfig()
+
+	if _, err := os.Stat(configFile()); os.IsNotExist(err) {
+		color.Red("Your server is not configured to use ServerAuth!")
+		fmt.Println("Please follow the instructions on your server details page inside your ServerAuth account, or contact us for assistance.")
+		os.Exit(1)
+	}
+
+	// Configs written by older versions of the agent are still read, but are
+	// only ever rewritten by config migrate
+	if readErr == nil {
+		if data, err := ioutil.ReadFile(configFile()); err == nil {
+			if _, applied, err := migrateConfigData(data); err == nil && len(applied) > 0 {
+				color.Yellow("The ServerAuth config is at version %d. Run `serverauth config migrate` to upgrade it to version %d.", applied[0].From, currentConfigVersion)
+			}
+		}
+	}
+
+	problems := loadConfigProblems(readErr)
+	if len(problems) > 0 {
+		color.Red("There are problems with your ServerAuth configuration:")
+		printConfigProblems(problems)
+		os.Exit(1)
+	}
+}
+
+// skipsConfigCheck reports whether cmd runs without checking the config:
+// cobra's help and shell completion commands, and those annotated with
+// skipConfigValidation.
+func skipsConfigCheck(cmd *cobra.Command) bool {
+	switch cmd.Name() {
+	case "help", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return true
+	}
+	if cmd.HasParent() && cmd.Parent().Name() == "completion" {
+		return true
+	}
+
+	_, skip := cmd.Annotations[skipConfigValidation]
+	return skip
+}
+
+// loadConfigProblems validates the config, falling back to the error from
+// reading it if validation didn't find anything more specific.
+func loadConfigProblems(readErr error) []configProblem {
+	problems, err := validateConfig()
+	if err != nil {
+		color.Red("Unable to read the ServerAuth config: %s", err)
+		os.Exit(1)
+	}
+
+	if len(problems) == 0 && readErr != nil {
+		problems = append(problems, configProblem{File: configFile(), Message: readErr.Error()})
+	}
+	return problems
+}
+
+// printConfigProblems lists config problems, one per line.
+func printConfigProblems(problems []configProblem) {
+	for _, problem := range problems {
+		fmt.Println("  " + problem.String())
+	}
+}
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the ServerAuth configuration",
+	Long:  `Commands for checking and maintaining the ServerAuth configuration file.`,
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:         "validate",
+	Short:       "Check the configuration for problems",
+	Long:        `Check the config file and any drop-in files against the configuration schema, reporting every problem found along with its line number.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		problems := loadConfigProblems(readConfig())
+
+		if len(problems) == 0 {
+			color.Green("The ServerAuth configuration in %s is valid.", configFile())
+			return
+		}
+
+		color.Red("Found %d problem(s) with the ServerAuth configuration:", len(problems))
+		printConfigProblems(problems)
+		os.Exit(1)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+}
@@ -0,0 +1,361 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// accountSettingNames are the names of an account's settings, as the agent
+// writes them
+var accountSettingNames = []string{"username", "apiKey", "createUser", "shell", "home", "group", "groups", "userCreated"}
+
+// updateConfig applies fn to the main config file while holding the config
+// lock. The file is re-read once the lock is held, and fn changes the YAML
+// document itself, so comments and the order and names of settings are kept.
+func updateConfig(fn func(root *yaml.Node) error) error {
+	err := lockConfig(func(path string) error {
+		return editConfigFile(path, fn)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Pick up the new contents for the rest of this run
+	viper.SetConfigFile(configFile())
+	return readConfig()
+}
+
+// updateAccounts edits a profile's accounts list under the config lock. A
+// system user can only ever be managed by a single profile.
+//
+// Drop-ins replace the accounts list rather than adding to it, so the list
+// is edited in the last file that sets it, which may be a drop-in.
+func updateAccounts(profile string, fn func(accounts []Account) ([]Account, error)) error {
+	err := lockConfig(func(path string) error {
+		dropIns, err := configDropIns(path)
+		if err != nil {
+			return err
+		}
+
+		target := path
+		for _, dropIn := range dropIns {
+			if setsAccounts, err := configFileSetsAccounts(dropIn, profile); err != nil {
+				return err
+			} else if setsAccounts {
+				target = dropIn
+			}
+		}
+
+		// Every profile is checked as it is now, drop-ins included
+		merged, err := mergedConfig(path, dropIns)
+		if err != nil {
+			return err
+		}
+
+		return editConfigFile(target, func(root *yaml.Node) error {
+			list := accountsNode(root, profile)
+
+			accounts, err := decodeAccounts(list)
+			if err != nil {
+				return fmt.Errorf("the accounts list in %s is invalid: %v", target, err)
+			}
+
+			updated, err := fn(accounts)
+			if err != nil {
+				return err
+			}
+
+			for _, account := range updated {
+				if other, _, ok := accountProfile(merged, account.Username); ok && other != profile {
+					return fmt.Errorf("%s is already managed by the %s profile", account.Username, other)
+				}
+			}
+
+			return encodeAccounts(list, updated)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	viper.SetConfigFile(configFile())
+	return readConfig()
+}
+
+// editConfigFile applies fn to the root of a config file's YAML document and
+// atomically writes the result. A missing file is created at the current
+// config version. The config lock must be held.
+func editConfigFile(path string, fn func(root *yaml.Node) error) error {
+	perm := os.FileMode(0600)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if info, err := os.Stat(path); err == nil {
+			perm = info.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("unable to read %s: %v", path, err)
+	}
+
+	// New config files start out at the current version
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+		setConfigVersion(doc.Content[0], currentConfigVersion)
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s must be a set of settings", path)
+	}
+
+	if err := fn(root); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	encoder.Close()
+
+	if err := writeFileAtomic(path, out.Bytes(), perm); err != nil {
+		return fmt.Errorf("unable to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// mergedConfig reads a main config file and its drop-ins into a new viper,
+// as readConfig does.
+func mergedConfig(path string, dropIns []string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+
+	for i, file := range append([]string{path}, dropIns...) {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) && i == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := v.MergeConfig(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", file, err)
+		}
+	}
+
+	return v, nil
+}
+
+// configFileSetsAccounts reports whether a config file sets the accounts of
+// a profile.
+func configFileSetsAccounts(path, profile string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return false, nil
+	}
+
+	node := doc.Content[0]
+	if profile != defaultProfile {
+		if node = mappingValue(node, "profiles"); node == nil || node.Kind != yaml.MappingNode {
+			return false, nil
+		}
+		if node = mappingValue(node, profile); node == nil || node.Kind != yaml.MappingNode {
+			return false, nil
+		}
+	}
+	return mappingValue(node, "accounts") != nil, nil
+}
+
+// accountsNode returns the accounts list of a profile, adding the profile
+// and an empty list to the document when they aren't there yet.
+func accountsNode(root *yaml.Node, profile string) *yaml.Node {
+	node := root
+	if profile != defaultProfile {
+		node = mappingNode(mappingNode(root, "profiles"), profile)
+	}
+
+	list := mappingValue(node, "accounts")
+	if list == nil {
+		list = &yaml.Node{}
+		setMappingValue(node, "accounts", list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		*list = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", LineComment: list.LineComment, HeadComment: list.HeadComment}
+	}
+	return list
+}
+
+// mappingNode returns the set of settings under key in a mapping, adding it
+// when it isn't there yet.
+func mappingNode(mapping *yaml.Node, key string) *yaml.Node {
+	node := mappingValue(mapping, key)
+	if node == nil {
+		node = &yaml.Node{}
+		setMappingValue(mapping, key, node)
+	}
+	if node.Kind != yaml.MappingNode {
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", LineComment: node.LineComment, HeadComment: node.HeadComment}
+	}
+	return node
+}
+
+// setMappingValue sets key in a mapping, keeping the name and comments of
+// a setting that is already there, in any case.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			old := mapping.Content[i+1]
+			value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// setMappingString sets key in a mapping to a string.
+func setMappingString(mapping *yaml.Node, key, value string) {
+	node := &yaml.Node{}
+	node.Encode(value)
+	setMappingValue(mapping, key, node)
+}
+
+// removeMappingValue removes key, in any case, from a mapping.
+func removeMappingValue(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// decodeAccounts reads an accounts list. Settings may have been written in
+// any case, as viper reads them.
+func decodeAccounts(list *yaml.Node) ([]Account, error) {
+	var accounts []Account
+	for _, node := range list.Content {
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: each account must be a set of settings", node.Line)
+		}
+
+		canonical := *node
+		canonical.Content = nil
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := *node.Content[i]
+			for _, name := range accountSettingNames {
+				if strings.EqualFold(key.Value, name) {
+					key.Value = name
+				}
+			}
+			canonical.Content = append(canonical.Content, &key, node.Content[i+1])
+		}
+
+		var account Account
+		if err := canonical.Decode(&account); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// encodeAccounts replaces the accounts in a list. Accounts that were already
+// in the list are updated in place, so their comments and the names of their
+// settings are kept.
+func encodeAccounts(list *yaml.Node, accounts []Account) error {
+	existing := map[string]*yaml.Node{}
+	for _, node := range list.Content {
+		if username := mappingValue(node, "username"); username != nil && existing[username.Value] == nil {
+			existing[username.Value] = node
+		}
+	}
+
+	var content []*yaml.Node
+	for _, account := range accounts {
+		encoded := &yaml.Node{}
+		if err := encoded.Encode(account); err != nil {
+			return err
+		}
+
+		node, ok := existing[account.Username]
+		if !ok {
+			content = append(content, encoded)
+			continue
+		}
+		delete(existing, account.Username)
+
+		for _, name := range accountSettingNames {
+			value := mappingValue(encoded, name)
+			if value == nil {
+				removeMappingValue(node, name)
+			} else if current := mappingValue(node, name); current == nil || !sameYAML(current, value) {
+				setMappingValue(node, name, value)
+			}
+		}
+		content = append(content, node)
+	}
+
+	// An empty list is often written as [], but accounts read better as a
+	// block
+	if len(content) > 0 {
+		list.Style &^= yaml.FlowStyle
+	}
+	list.Content = content
+	return nil
+}
+
+// sameYAML reports whether two YAML nodes hold the same value, however they
+// are written.
+func sameYAML(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !sameYAML(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,280 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// useTestConfig points the agent at a config file in a fresh directory for
+// the rest of the test, returning its path.
+func useTestConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Reset()
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+	return path
+}
+
+// readTestFile returns the contents of a file written by a test.
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpdateAccountsKeepsComments(t *testing.T) {
+	path := useTestConfig(t, `# ServerAuth agent config
+version: 1
+orgid: org-123 # the organisation
+apikey: file:/etc/serverauth/server.key
+
+# Accounts managed on this server
+accounts:
+    # The deploy user
+    - username: deploy
+      apikey: deploy-key # lower case, as viper wrote it
+      groups: [www-data]
+    - username: backup
+      apiKey: env:BACKUP_KEY
+
+monitor:
+    format: form
+`)
+
+	err := updateAccounts(defaultProfile, func(accounts []Account) ([]Account, error) {
+		if len(accounts) != 2 || accounts[0].ApiKey != "deploy-key" || accounts[1].ApiKey != "env:BACKUP_KEY" {
+			t.Errorf("accounts = %+v, want deploy and backup with their keys", accounts)
+		}
+		accounts[0].UserCreated = true
+		return append(accounts[1:2:2], accounts[0], Account{Username: "web", ApiKey: "web-key", Shell: "/bin/bash"}), nil
+	})
+	if err != nil {
+		t.Fatalf("updateAccounts() error = %v", err)
+	}
+
+	want := `# ServerAuth agent config
+version: 1
+orgid: org-123 # the organisation
+apikey: file:/etc/serverauth/server.key
+# Accounts managed on this server
+accounts:
+    - username: backup
+      apiKey: env:BACKUP_KEY
+    # The deploy user
+    - username: deploy
+      apikey: deploy-key # lower case, as viper wrote it
+      groups: [www-data]
+      userCreated: true
+    - username: web
+      apiKey: web-key
+      shell: /bin/bash
+monitor:
+    format: form
+`
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("config after updateAccounts() =\n%s\nwant\n%s", got, want)
+	}
+
+	if accounts, _ := profileAccounts(viper.GetViper(), defaultProfile); len(accounts) != 3 {
+		t.Errorf("the config wasn't re-read, accounts = %+v", accounts)
+	}
+}
+
+func TestUpdateAccountsEmptyList(t *testing.T) {
+	path := useTestConfig(t, "version: 1\naccounts: []\n")
+
+	err := updateAccounts(defaultProfile, func(accounts []Account) ([]Account, error) {
+		return append(accounts, Account{Username: "deploy", ApiKey: "deploy-key", Groups: []string{"adm"}}), nil
+	})
+	if err != nil {
+		t.Fatalf("updateAccounts() error = %v", err)
+	}
+
+	want := "version: 1\naccounts:\n    - username: deploy\n      apiKey: deploy-key\n      groups:\n        - adm\n"
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("config after updateAccounts() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUpdateAccountsNamedProfile(t *testing.T) {
+	path := useTestConfig(t, `version: 1
+profiles:
+    staging:
+        orgid: org-456 # staging
+`)
+
+	err := updateAccounts("staging", func(accounts []Account) ([]Account, error) {
+		return append(accounts, Account{Username: "deploy", ApiKey: "deploy-key"}), nil
+	})
+	if err != nil {
+		t.Fatalf("updateAccounts() error = %v", err)
+	}
+
+	want := `version: 1
+profiles:
+    staging:
+        orgid: org-456 # staging
+        accounts:
+            - username: deploy
+              apiKey: deploy-key
+`
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("config after updateAccounts() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Drop-ins replace the accounts list, so an account added to the main file
+// would be hidden by a drop-in that sets it.
+func TestUpdateAccountsInDropIn(t *testing.T) {
+	main := `version: 1
+orgid: org-123
+accounts:
+    - username: ignored
+      apiKey: ignored-key
+`
+	path := useTestConfig(t, main)
+
+	dir := filepath.Join(filepath.Dir(path), "conf.d")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dropIn := filepath.Join(dir, "50-accounts.yaml")
+	if err := ioutil.WriteFile(dropIn, []byte("# Managed by config management\naccounts:\n    - username: deploy\n      apiKey: deploy-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "90-other.yaml"), []byte("monitor:\n    format: form\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := updateAccounts(defaultProfile, func(accounts []Account) ([]Account, error) {
+		if len(accounts) != 1 || accounts[0].Username != "deploy" {
+			t.Errorf("accounts = %+v, want the accounts from the drop-in", accounts)
+		}
+		return append(accounts, Account{Username: "web", ApiKey: "web-key"}), nil
+	})
+	if err != nil {
+		t.Fatalf("updateAccounts() error = %v", err)
+	}
+
+	if got := readTestFile(t, path); got != main {
+		t.Errorf("main config changed to\n%s", got)
+	}
+	want := `# Managed by config management
+accounts:
+    - username: deploy
+      apiKey: deploy-key
+    - username: web
+      apiKey: web-key
+`
+	if got := readTestFile(t, dropIn); got != want {
+		t.Errorf("drop-in after updateAccounts() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUpdateAccountsOtherProfile(t *testing.T) {
+	useTestConfig(t, `version: 1
+accounts:
+    - username: deploy
+      apiKey: deploy-key
+profiles:
+    staging:
+        orgid: org-456
+`)
+
+	err := updateAccounts("staging", func(accounts []Account) ([]Account, error) {
+		return append(accounts, Account{Username: "deploy", ApiKey: "other-key"}), nil
+	})
+	if err == nil {
+		t.Error("updateAccounts() expected an error for a user managed by another profile")
+	}
+}
+
+func TestUpdateConfigNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	viper.Reset()
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+
+	err := updateConfig(func(root *yaml.Node) error {
+		setMappingString(root, "orgid", "org-123")
+		setMappingString(root, "apikey", "true")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("updateConfig() error = %v", err)
+	}
+
+	want := "version: 1\norgid: org-123\napikey: \"true\"\n"
+	if got := readTestFile(t, path); got != want {
+		t.Errorf("new config =\n%s\nwant\n%s", got, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("new config mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+// On a new server, e.g. when init runs from cloud-init, the config directory
+// doesn't exist yet.
+func TestUpdateConfigMissingDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "etc", "serverauth", "config.yaml")
+	viper.Reset()
+	viper.SetConfigFile(path)
+	t.Cleanup(viper.Reset)
+
+	err := updateConfig(func(root *yaml.Node) error {
+		setMappingString(root, "orgid", "org-123")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("updateConfig() error = %v", err)
+	}
+
+	if got, want := readTestFile(t, path), "version: 1\norgid: org-123\n"; got != want {
+		t.Errorf("new config =\n%s\nwant\n%s", got, want)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("config directory mode = %v, want 0700", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/spf13/viper"
+)
+
+// cpuTimesFile keeps the CPU counters from the previous monitor run, so
+// utilisation can be worked out without sampling for a second
+const cpuTimesFile = "cpu-times.json"
+
+// cpuTimesSample is the contents of the CPU counters state file
+type cpuTimesSample struct {
+	Time    time.Time       `json:"time"`
+	Total   cpu.TimesStat   `json:"total"`
+	PerCore []cpu.TimesStat `json:"perCore"`
+}
+
+// cpuCollector reports the processors and their utilisation. The per-core
+// figures can be turned off with percore: false on servers with many cores.
+type cpuCollector struct{}
+
+func (cpuCollector) Name() string { return "cpu" }
+
+func (cpuCollector) Settings() map[string]*schemaField {
+	return map[string]*schemaField{
+		"percore": {Kind: kindBool},
+	}
+}
+
+func (c cpuCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	key := collectorKey(c.Name(), "percore")
+	perCore := !viper.IsSet(key) || viper.GetBool(key)
+
+	var err error
+	p.CPU, err = collectCPUMetrics(ctx, perCore, state)
+	return err
+}
+
+// collectCPUMetrics reads the processor details and the CPU counters, and
+// works out utilisation from the counters saved by the previous run.
+func collectCPUMetrics(ctx context.Context, perCore bool, state collectorState) (*metrics.CPU, error) {
+	result := &metrics.CPU{}
+
+	info, err := cpu.InfoWithContext(ctx)
+	if err != nil {
+		return result, err
+	}
+	if len(info) > 0 {
+		result.Model = info[0].ModelName
+	}
+
+	if result.Cores, err = cpu.CountsWithContext(ctx, false); err != nil {
+		return result, err
+	}
+	if result.Threads, err = cpu.CountsWithContext(ctx, true); err != nil {
+		return result, err
+	}
+
+	total, err := cpu.TimesWithContext(ctx, false)
+	if err != nil {
+		return result, err
+	}
+	if len(total) == 0 {
+		return result, fmt.Errorf("no CPU times were reported")
+	}
+	cores, err := cpu.TimesWithContext(ctx, true)
+	if err != nil {
+		return result, err
+	}
+
+	current := cpuTimesSample{Time: time.Now(), Total: total[0], PerCore: cores}
+
+	var previous cpuTimesSample
+	if err := readState(cpuTimesFile, &previous); err != nil {
+		return result, err
+	}
+	state[cpuTimesFile] = &current
+
+	result.Usage, result.PerCore = cpuUsageSince(previous, current, perCore)
+	return result, nil
+}
+
+// cpuUsageSince works out the CPU usage since the previous sample. Nothing is
+// returned without a previous sample, or when the counters have started
+// again from zero after a reboot. Per core usage is left out when the number
+// of cores has changed.
+func cpuUsageSince(previous, current cpuTimesSample, perCore bool) (*metrics.CPUUsage, []metrics.CPUUsage) {
+	if previous.Time.IsZero() || cpuTime(current.Total) <= cpuTime(previous.Total) {
+		return nil, nil
+	}
+
+	usage := cpuUsageBetween(previous.Total, current.Total)
+
+	var cores []metrics.CPUUsage
+	if perCore && len(previous.PerCore) == len(current.PerCore) {
+		for i := range current.PerCore {
+			cores = append(cores, cpuUsageBetween(previous.PerCore[i], current.PerCore[i]))
+		}
+	}
+
+	return &usage, cores
+}
+
+// cpuTime is the total time counted by a set of CPU counters. Guest time is
+// already counted in user and nice time, so unlike TimesStat.Total it isn't
+// added again.
+func cpuTime(t cpu.TimesStat) float64 {
+	return t.User + t.Nice + t.System + t.Idle + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// cpuUsageBetween works out the CPU usage between two samples of the same
+// counters.
+func cpuUsageBetween(previous, current cpu.TimesStat) metrics.CPUUsage {
+	elapsed := cpuTime(current) - cpuTime(previous)
+	if elapsed <= 0 {
+		return metrics.CPUUsage{IdlePercent: 100}
+	}
+
+	percent := func(before, after float64) float64 {
+		p := (after - before) / elapsed * 100
+		if p < 0 {
+			return 0
+		}
+		return p
+	}
+
+	usage := metrics.CPUUsage{
+		UserPercent:   percent(previous.User+previous.Nice, current.User+current.Nice),
+		SystemPercent: percent(previous.System+previous.Irq+previous.Softirq, current.System+current.Irq+current.Softirq),
+		IOWaitPercent: percent(previous.Iowait, current.Iowait),
+		StealPercent:  percent(previous.Steal, current.Steal),
+		IdlePercent:   percent(previous.Idle, current.Idle),
+	}
+	usage.UsedPercent = 100 - usage.IdlePercent - usage.IOWaitPercent
+	if usage.UsedPercent < 0 {
+		usage.UsedPercent = 0
+	}
+
+	return usage
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/cpu"
+)
+
+// sameUsage reports whether two usages match, allowing for rounding.
+func sameUsage(a, b metrics.CPUUsage) bool {
+	near := func(x, y float64) bool { return math.Abs(x-y) < 1e-9 }
+	return near(a.UsedPercent, b.UsedPercent) && near(a.UserPercent, b.UserPercent) &&
+		near(a.SystemPercent, b.SystemPercent) && near(a.IOWaitPercent, b.IOWaitPercent) &&
+		near(a.StealPercent, b.StealPercent) && near(a.IdlePercent, b.IdlePercent)
+}
+
+func TestCPUUsageBetween(t *testing.T) {
+	tests := []struct {
+		name              string
+		previous, current cpu.TimesStat
+		want              metrics.CPUUsage
+	}{
+		{
+			name:     "every state",
+			previous: cpu.TimesStat{User: 100, Nice: 10, System: 50, Idle: 800, Iowait: 20, Irq: 5, Softirq: 5, Steal: 10},
+			current:  cpu.TimesStat{User: 130, Nice: 10, System: 60, Idle: 850, Iowait: 25, Irq: 5, Softirq: 5, Steal: 15},
+			want:     metrics.CPUUsage{UsedPercent: 45, UserPercent: 30, SystemPercent: 10, IOWaitPercent: 5, StealPercent: 5, IdlePercent: 50},
+		},
+		{
+			// The kernel counts guest time in user and nice time as well, so
+			// it must not make the elapsed time longer
+			name:     "guest time",
+			previous: cpu.TimesStat{User: 100, Idle: 100, Guest: 50, GuestNice: 10},
+			current:  cpu.TimesStat{User: 175, Idle: 125, Guest: 110, GuestNice: 25},
+			want:     metrics.CPUUsage{UsedPercent: 75, UserPercent: 75, IdlePercent: 25},
+		},
+		{
+			name:     "no time has passed",
+			previous: cpu.TimesStat{User: 100, Idle: 100},
+			current:  cpu.TimesStat{User: 100, Idle: 100},
+			want:     metrics.CPUUsage{IdlePercent: 100},
+		},
+		{
+			name:     "counter went backwards",
+			previous: cpu.TimesStat{User: 100, System: 50, Idle: 100},
+			current:  cpu.TimesStat{User: 150, System: 40, Idle: 160},
+			want:     metrics.CPUUsage{UsedPercent: 40, UserPercent: 50, IdlePercent: 60},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cpuUsageBetween(tt.previous, tt.current); !sameUsage(got, tt.want) {
+				t.Errorf("cpuUsageBetween() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUUsageSince(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	busy := cpu.TimesStat{User: 100, Idle: 100}
+	later := cpu.TimesStat{User: 150, Idle: 150}
+
+	tests := []struct {
+		name              string
+		previous, current cpuTimesSample
+		perCore           bool
+		usage             bool
+		cores             int
+	}{
+		{
+			name:    "first run",
+			current: cpuTimesSample{Time: start, Total: busy},
+			perCore: true,
+			usage:   false,
+			cores:   0,
+		},
+		{
+			name:     "per core",
+			previous: cpuTimesSample{Time: start, Total: busy, PerCore: []cpu.TimesStat{busy, busy}},
+			current:  cpuTimesSample{Time: start.Add(time.Minute), Total: later, PerCore: []cpu.TimesStat{later, later}},
+			perCore:  true,
+			usage:    true,
+			cores:    2,
+		},
+		{
+			name:     "per core turned off",
+			previous: cpuTimesSample{Time: start, Total: busy, PerCore: []cpu.TimesStat{busy, busy}},
+			current:  cpuTimesSample{Time: start.Add(time.Minute), Total: later, PerCore: []cpu.TimesStat{later, later}},
+			perCore:  false,
+			usage:    true,
+			cores:    0,
+		},
+		{
+			name:     "counters reset by a reboot",
+			previous: cpuTimesSample{Time: start, Total: later, PerCore: []cpu.TimesStat{later}},
+			current:  cpuTimesSample{Time: start.Add(time.Minute), Total: busy, PerCore: []cpu.TimesStat{busy}},
+			perCore:  true,
+			usage:    false,
+			cores:    0,
+		},
+		{
+			name:     "a core was added",
+			previous: cpuTimesSample{Time: start, Total: busy, PerCore: []cpu.TimesStat{busy}},
+			current:  cpuTimesSample{Time: start.Add(time.Minute), Total: later, PerCore: []cpu.TimesStat{later, later}},
+			perCore:  true,
+			usage:    true,
+			cores:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage, cores := cpuUsageSince(tt.previous, tt.current, tt.perCore)
+			if (usage != nil) != tt.usage {
+				t.Errorf("cpuUsageSince() usage = %+v, want usage %v", usage, tt.usage)
+			}
+			if len(cores) != tt.cores {
+				t.Errorf("cpuUsageSince() returned %d cores, want %d", len(cores), tt.cores)
+			}
+		})
+	}
+}
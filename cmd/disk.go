@@ -0,0 +1,300 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/spf13/viper"
+)
+
+// diskIOFile keeps the block device counters from the previous monitor run
+const diskIOFile = "disk-io.json"
+
+// pseudoFilesystems are kernel and memory backed filesystems, which are not
+// reported unless they are included explicitly
+var pseudoFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "efivarfs": true,
+	"fusectl": true, "fuse.lxcfs": true, "fuse.gvfsd-fuse": true, "fuse.portal": true,
+	"hugetlbfs": true, "mqueue": true, "nsfs": true, "overlay": true, "proc": true,
+	"pstore": true, "ramfs": true, "rpc_pipefs": true, "securityfs": true, "selinuxfs": true,
+	"squashfs": true, "sysfs": true, "tmpfs": true, "tracefs": true,
+}
+
+// ignoredBlockDevices are prefixes of block devices that never hold data
+// worth reporting
+var ignoredBlockDevices = []string{"loop", "ram", "zram", "fd", "sr"}
+
+// diskIOSample is the contents of the block device counters state file
+type diskIOSample struct {
+	Time     time.Time                      `json:"time"`
+	Counters map[string]disk.IOCountersStat `json:"counters"`
+}
+
+// diskMetrics holds every reported filesystem and block device
+type diskMetrics struct {
+	Filesystems []metrics.Filesystem
+
+	// Devices is empty when there was no previous sample to compare with
+	Devices []metrics.DiskIO
+}
+
+// filesystemFilter decides which filesystems are reported, using globs
+// matched against the mountpoint and the filesystem type
+type filesystemFilter struct {
+	IncludeMountpoints []string
+	IncludeFSTypes     []string
+	ExcludeMountpoints []string
+	ExcludeFSTypes     []string
+}
+
+// loadFilesystemFilter reads the filesystem filter from the config.
+func loadFilesystemFilter() filesystemFilter {
+	key := collectorKey("disk", "filesystems")
+	return filesystemFilter{
+		IncludeMountpoints: viper.GetStringSlice(key + ".include.mountpoints"),
+		IncludeFSTypes:     viper.GetStringSlice(key + ".include.fstypes"),
+		ExcludeMountpoints: viper.GetStringSlice(key + ".exclude.mountpoints"),
+		ExcludeFSTypes:     viper.GetStringSlice(key + ".exclude.fstypes"),
+	}
+}
+
+// reports decides whether a filesystem is reported. Excludes always win.
+// When there are includes, only matching filesystems are reported, otherwise
+// every real filesystem and the root filesystem are.
+func (f filesystemFilter) reports(partition disk.PartitionStat) bool {
+	if matchesAny(f.ExcludeMountpoints, partition.Mountpoint) || matchesAny(f.ExcludeFSTypes, partition.Fstype) {
+		return false
+	}
+
+	if len(f.IncludeMountpoints) > 0 || len(f.IncludeFSTypes) > 0 {
+		return matchesAny(f.IncludeMountpoints, partition.Mountpoint) || matchesAny(f.IncludeFSTypes, partition.Fstype)
+	}
+
+	return partition.Mountpoint == "/" || !pseudoFilesystems[partition.Fstype]
+}
+
+// matchesAny reports whether value matches any of the glob patterns.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// diskCollector reports filesystem usage and block device activity. The
+// filesystems reported are chosen with the filesystems setting.
+type diskCollector struct{}
+
+func (diskCollector) Name() string { return "disk" }
+
+func (diskCollector) Settings() map[string]*schemaField {
+	return map[string]*schemaField{
+		"filesystems": {
+			Kind: kindMap,
+			Fields: map[string]*schemaField{
+				"include": filesystemPatterns,
+				"exclude": filesystemPatterns,
+			},
+		},
+	}
+}
+
+func (diskCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	result, err := collectDiskMetrics(ctx, state)
+	p.Filesystems = result.Filesystems
+	p.DiskIO = result.Devices
+	return err
+}
+
+// collectDiskMetrics reports the usage of every mounted filesystem that
+// passes the filter, and the activity of every block device.
+func collectDiskMetrics(ctx context.Context, state collectorState) (diskMetrics, error) {
+	var result diskMetrics
+
+	partitions, err := disk.PartitionsWithContext(ctx, true)
+	if err != nil {
+		return result, err
+	}
+
+	filter := loadFilesystemFilter()
+	seen := map[string]bool{}
+	for _, partition := range partitions {
+		if !filter.reports(partition) {
+			continue
+		}
+
+		// Bind mounts show the same filesystem more than once
+		if strings.HasPrefix(partition.Device, "/dev/") {
+			if seen[partition.Device] {
+				continue
+			}
+			seen[partition.Device] = true
+		}
+
+		fs := metrics.Filesystem{
+			Mountpoint: partition.Mountpoint,
+			Device:     partition.Device,
+			FSType:     partition.Fstype,
+		}
+
+		usage, err := disk.UsageWithContext(ctx, partition.Mountpoint)
+		if err != nil {
+			// Filesystems can be unmounted, or hang, between listing and
+			// reading them, which shouldn't stop the rest being reported
+			fs.Error = err.Error()
+			result.Filesystems = append(result.Filesystems, fs)
+			continue
+		}
+
+		fs.TotalBytes = usage.Total
+		fs.UsedBytes = usage.Used
+		fs.FreeBytes = usage.Free
+		fs.UsedPercent = usage.UsedPercent
+		fs.InodesTotal = usage.InodesTotal
+		fs.InodesUsed = usage.InodesUsed
+		fs.InodesFree = usage.InodesFree
+		result.Filesystems = append(result.Filesystems, fs)
+	}
+
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	current := diskIOSample{Time: time.Now(), Counters: map[string]disk.IOCountersStat{}}
+	for name, counter := range counters {
+		// A partition's activity is already counted in its disk's
+		if !ignoredBlockDevice(name) && !isPartition(name, counters) {
+			current.Counters[name] = counter
+		}
+	}
+
+	var previous diskIOSample
+	if err := readState(diskIOFile, &previous); err != nil {
+		return result, err
+	}
+	state[diskIOFile] = &current
+
+	elapsed := current.Time.Sub(previous.Time).Seconds()
+	if previous.Time.IsZero() || elapsed <= 0 {
+		return result, nil
+	}
+
+	for _, name := range sortedDeviceNames(current.Counters) {
+		before, ok := previous.Counters[name]
+		after := current.Counters[name]
+
+		// The counters start again from zero when the server reboots
+		if !ok || after.ReadCount < before.ReadCount || after.WriteCount < before.WriteCount {
+			continue
+		}
+
+		result.Devices = append(result.Devices, diskIOBetween(name, before, after, elapsed))
+	}
+
+	return result, nil
+}
+
+// diskIOBetween works out the activity of a block device between two
+// samples of its counters, elapsed seconds apart.
+func diskIOBetween(name string, before, after disk.IOCountersStat, elapsed float64) metrics.DiskIO {
+	reads := float64(after.ReadCount - before.ReadCount)
+	writes := float64(after.WriteCount - before.WriteCount)
+
+	result := metrics.DiskIO{
+		Device:              name,
+		ReadOpsPerSecond:    reads / elapsed,
+		WriteOpsPerSecond:   writes / elapsed,
+		ReadBytesPerSecond:  float64(after.ReadBytes-before.ReadBytes) / elapsed,
+		WriteBytesPerSecond: float64(after.WriteBytes-before.WriteBytes) / elapsed,
+		UtilisationPercent:  float64(after.IoTime-before.IoTime) / (elapsed * 1000) * 100,
+	}
+
+	// The time counters are the total milliseconds spent on every request
+	if reads > 0 {
+		result.ReadLatencyMilliseconds = float64(after.ReadTime-before.ReadTime) / reads
+	}
+	if writes > 0 {
+		result.WriteLatencyMilliseconds = float64(after.WriteTime-before.WriteTime) / writes
+	}
+	if result.UtilisationPercent > 100 {
+		result.UtilisationPercent = 100
+	}
+
+	return result
+}
+
+// ignoredBlockDevice reports whether a block device is left out of the
+// metrics.
+func ignoredBlockDevice(name string) bool {
+	for _, prefix := range ignoredBlockDevices {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPartition reports whether a block device is a partition of another
+// device in counters, e.g. sda1 of sda or nvme0n1p1 of nvme0n1.
+func isPartition(name string, counters map[string]disk.IOCountersStat) bool {
+	for parent := range counters {
+		if parent == name || !strings.HasPrefix(name, parent) {
+			continue
+		}
+
+		// Disks whose names end in a digit separate the partition number
+		// with a p
+		number := strings.TrimPrefix(name, parent)
+		if last := parent[len(parent)-1]; last >= '0' && last <= '9' {
+			if !strings.HasPrefix(number, "p") {
+				continue
+			}
+			number = number[1:]
+		}
+		if number != "" && strings.Trim(number, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedDeviceNames returns the device names in order, so they are always
+// reported the same way.
+func sortedDeviceNames(counters map[string]disk.IOCountersStat) []string {
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,186 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/disk"
+)
+
+func TestFilesystemFilterReports(t *testing.T) {
+	root := disk.PartitionStat{Device: "/dev/sda1", Mountpoint: "/", Fstype: "ext4"}
+	home := disk.PartitionStat{Device: "/dev/sda2", Mountpoint: "/home", Fstype: "xfs"}
+	mnt := disk.PartitionStat{Device: "nas:/backups", Mountpoint: "/mnt/backups", Fstype: "nfs4"}
+	tmp := disk.PartitionStat{Device: "tmpfs", Mountpoint: "/tmp", Fstype: "tmpfs"}
+	rootTmpfs := disk.PartitionStat{Device: "rootfs", Mountpoint: "/", Fstype: "tmpfs"}
+
+	tests := []struct {
+		name      string
+		filter    filesystemFilter
+		partition disk.PartitionStat
+		want      bool
+	}{
+		{name: "real filesystem", partition: home, want: true},
+		{name: "pseudo filesystem", partition: tmp, want: false},
+		{name: "root is always reported", partition: rootTmpfs, want: true},
+		{
+			name:      "excluded mountpoint glob",
+			filter:    filesystemFilter{ExcludeMountpoints: []string{"/mnt/*"}},
+			partition: mnt,
+			want:      false,
+		},
+		{
+			name:      "excluded fstype glob",
+			filter:    filesystemFilter{ExcludeFSTypes: []string{"nfs*"}},
+			partition: mnt,
+			want:      false,
+		},
+		{
+			name:      "excluded root",
+			filter:    filesystemFilter{ExcludeMountpoints: []string{"/"}},
+			partition: root,
+			want:      false,
+		},
+		{
+			name:      "included pseudo filesystem",
+			filter:    filesystemFilter{IncludeFSTypes: []string{"tmpfs"}},
+			partition: tmp,
+			want:      true,
+		},
+		{
+			name:      "not included",
+			filter:    filesystemFilter{IncludeMountpoints: []string{"/home"}},
+			partition: root,
+			want:      false,
+		},
+		{
+			name:      "included by mountpoint",
+			filter:    filesystemFilter{IncludeMountpoints: []string{"/home"}, IncludeFSTypes: []string{"ext*"}},
+			partition: home,
+			want:      true,
+		},
+		{
+			name:      "exclude wins over include",
+			filter:    filesystemFilter{IncludeFSTypes: []string{"xfs"}, ExcludeMountpoints: []string{"/home"}},
+			partition: home,
+			want:      false,
+		},
+		{
+			name:      "glob doesn't cross directories",
+			filter:    filesystemFilter{ExcludeMountpoints: []string{"/*"}},
+			partition: mnt,
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.reports(tt.partition); got != tt.want {
+				t.Errorf("reports(%s %s) = %v, want %v", tt.partition.Mountpoint, tt.partition.Fstype, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskIOBetween(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after disk.IOCountersStat
+		elapsed       float64
+		want          metrics.DiskIO
+	}{
+		{
+			name:    "reads and writes",
+			before:  disk.IOCountersStat{ReadCount: 100, WriteCount: 200, ReadBytes: 4096, WriteBytes: 8192, ReadTime: 50, WriteTime: 100, IoTime: 1000},
+			after:   disk.IOCountersStat{ReadCount: 300, WriteCount: 600, ReadBytes: 413696, WriteBytes: 827392, ReadTime: 450, WriteTime: 1300, IoTime: 4000},
+			elapsed: 10,
+			want: metrics.DiskIO{
+				Device:                   "sda",
+				ReadOpsPerSecond:         20,
+				WriteOpsPerSecond:        40,
+				ReadBytesPerSecond:       40960,
+				WriteBytesPerSecond:      81920,
+				ReadLatencyMilliseconds:  2,
+				WriteLatencyMilliseconds: 3,
+				UtilisationPercent:       30,
+			},
+		},
+		{
+			name:    "idle",
+			before:  disk.IOCountersStat{ReadCount: 100, WriteCount: 200, ReadTime: 50, WriteTime: 100},
+			after:   disk.IOCountersStat{ReadCount: 100, WriteCount: 200, ReadTime: 50, WriteTime: 100},
+			elapsed: 60,
+			want:    metrics.DiskIO{Device: "sda"},
+		},
+		{
+			// Queued requests can make the busy time overlap
+			name:    "utilisation is capped",
+			before:  disk.IOCountersStat{IoTime: 0},
+			after:   disk.IOCountersStat{IoTime: 12000},
+			elapsed: 10,
+			want:    metrics.DiskIO{Device: "sda", UtilisationPercent: 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diskIOBetween("sda", tt.before, tt.after, tt.elapsed); got != tt.want {
+				t.Errorf("diskIOBetween() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPartition(t *testing.T) {
+	counters := map[string]disk.IOCountersStat{}
+	for _, name := range []string{"sda", "sda1", "sda15", "sdab", "nvme0n1", "nvme0n1p1", "nvme0n10", "mmcblk0", "mmcblk0p2", "md0", "dm-0", "ada0", "ada0p3"} {
+		counters[name] = disk.IOCountersStat{}
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "sda", want: false},
+		{name: "sda1", want: true},
+		{name: "sda15", want: true},
+		{name: "sdab", want: false},
+		{name: "nvme0n1", want: false},
+		{name: "nvme0n1p1", want: true},
+		{name: "nvme0n10", want: false},
+		{name: "mmcblk0", want: false},
+		{name: "mmcblk0p2", want: true},
+		{name: "md0", want: false},
+		{name: "dm-0", want: false},
+		{name: "ada0p3", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPartition(tt.name, counters); got != tt.want {
+				t.Errorf("isPartition(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
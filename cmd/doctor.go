@@ -0,0 +1,498 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var doctorJSON bool
+
+// doctorStatus is the outcome of a single diagnostic check
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "pass"
+	doctorWarn doctorStatus = "warn"
+	doctorFail doctorStatus = "fail"
+)
+
+// doctorCheck is the result of a single diagnostic check, with a hint on
+// how to fix it when it didn't pass
+type doctorCheck struct {
+	Name    string       `json:"name"`
+	Status  doctorStatus `json:"status"`
+	Message string       `json:"message"`
+	Hint    string       `json:"hint,omitempty"`
+}
+
+// doctorReport is the full set of results, as printed with --json
+type doctorReport struct {
+	Checks  []doctorCheck        `json:"checks"`
+	Summary map[doctorStatus]int `json:"summary"`
+}
+
+// Limits used by the clock and last sync checks
+const (
+	clockSkewWarn     = 30 * time.Second
+	clockSkewFail     = 5 * time.Minute
+	certExpiryWarn    = 14 * 24 * time.Hour
+	lastSyncWarnAge   = time.Hour
+	lastSyncFailAge   = 24 * time.Hour
+	doctorDialTimeout = 5 * time.Second
+)
+
+// doctor collects check results as they are run
+type doctor struct {
+	checks []doctorCheck
+}
+
+func (d *doctor) pass(name, message string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: doctorPass, Message: message})
+}
+
+func (d *doctor) warn(name, message, hint string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: doctorWarn, Message: message, Hint: hint})
+}
+
+func (d *doctor) fail(name, message, hint string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: doctorFail, Message: message, Hint: hint})
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose problems with ServerAuth on this server",
+	Long: `Check the configuration, the connection to the ServerAuth API, every managed account and the agent's schedule, reporting how to fix anything that is wrong.
+
+Every check reports pass, warn or fail. The command exits with a non-zero status if any check fails.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &doctor{}
+		d.run()
+
+		report := doctorReport{Checks: d.checks, Summary: map[doctorStatus]int{doctorPass: 0, doctorWarn: 0, doctorFail: 0}}
+		for _, check := range d.checks {
+			report.Summary[check.Status]++
+		}
+
+		if doctorJSON {
+			out, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(out))
+		} else {
+			printDoctorReport(report)
+		}
+
+		if report.Summary[doctorFail] > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// run performs every check in turn. Checks that depend on an earlier one
+// passing are skipped when it fails.
+func (d *doctor) run() {
+	readErr := readConfig()
+
+	if !d.checkConfigFile() {
+		return
+	}
+	d.checkConfigValid(readErr)
+
+	v := viper.GetViper()
+	profiles := profileNames(v)
+	for _, profile := range profiles {
+		// Only name the profile when there is more than one
+		prefix := ""
+		if len(profiles) > 1 {
+			prefix = profile + ": "
+		}
+
+		server, err := loadServerConfig(profile, false)
+		if err != nil {
+			d.fail(prefix+"credentials", err.Error(), "Run `serverauth config validate`, or `serverauth init --token <token> --force` to enroll the server again")
+			continue
+		}
+		if server.TeamKeyErr != nil {
+			d.warn(prefix+"team key", server.TeamKeyErr.Error(), "Check the secret the teamkey setting refers to")
+		}
+
+		if d.checkAPI(prefix, server) {
+			d.checkAccounts(prefix, v, server)
+		}
+	}
+
+	d.checkSSHD()
+	d.checkSchedule()
+	d.checkLastSync()
+}
+
+// checkConfigFile checks the config file exists and only root can read it.
+func (d *doctor) checkConfigFile() bool {
+	path := configFile()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			d.fail("config file", path+" does not exist", "Run `serverauth init --token <token>` with the token from your ServerAuth account")
+		} else {
+			d.fail("config file", err.Error(), "Check the agent is running as root")
+		}
+		return false
+	}
+	d.pass("config file", path+" exists")
+
+	if info.Mode().Perm()&0077 != 0 {
+		d.warn("config permissions", fmt.Sprintf("%s has mode %04o, so other users can read it", path, info.Mode().Perm()), "Run `chmod 600 "+path+"`")
+	} else if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		d.warn("config permissions", fmt.Sprintf("%s is owned by uid %d rather than root", path, st.Uid), "Run `chown root:root "+path+"`")
+	} else {
+		d.pass("config permissions", fmt.Sprintf("%s is only readable by root", path))
+	}
+
+	return true
+}
+
+// checkConfigValid runs the same validation as `serverauth config validate`.
+func (d *doctor) checkConfigValid(readErr error) {
+	problems, err := validateConfig()
+	if err == nil && len(problems) == 0 && readErr != nil {
+		err = readErr
+	}
+	if err != nil {
+		d.fail("config valid", err.Error(), "Check the config is valid YAML")
+		return
+	}
+
+	if len(problems) > 0 {
+		var messages []string
+		for _, problem := range problems {
+			messages = append(messages, problem.String())
+		}
+		d.fail("config valid", strings.Join(messages, "; "), "Run `serverauth config validate` for details")
+		return
+	}
+
+	d.pass("config valid", "the config matches the schema")
+}
+
+// checkAPI checks the API can be resolved, reached over a trusted
+// connection, and that the server's clock agrees with it.
+func (d *doctor) checkAPI(prefix string, server serverConfig) bool {
+	u, err := url.Parse(server.BaseDomain)
+	if err != nil {
+		d.fail(prefix+"api url", err.Error(), "Check the basedomain setting")
+		return false
+	}
+
+	host := u.Hostname()
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		d.fail(prefix+"dns", fmt.Sprintf("unable to resolve %s: %s", host, err), "Check /etc/resolv.conf and that the server can reach its DNS servers")
+		return false
+	}
+	d.pass(prefix+"dns", fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")))
+
+	if u.Scheme == "https" {
+		port := u.Port()
+		if len(port) == 0 {
+			port = "443"
+		}
+
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: doctorDialTimeout}, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+		if err != nil {
+			d.fail(prefix+"tls", fmt.Sprintf("unable to make a trusted connection to %s: %s", host, err), "Check outbound access to port "+port+", any proxy, and that the CA certificates package is installed and up to date")
+			return false
+		}
+
+		expires := conn.ConnectionState().PeerCertificates[0].NotAfter
+		conn.Close()
+		if time.Until(expires) < certExpiryWarn {
+			d.warn(prefix+"tls", fmt.Sprintf("the certificate for %s expires on %s", host, expires.Format("2006-01-02")), "Contact ServerAuth support")
+		} else {
+			d.pass(prefix+"tls", fmt.Sprintf("trusted certificate for %s, valid until %s", host, expires.Format("2006-01-02")))
+		}
+	} else {
+		d.warn(prefix+"tls", server.BaseDomain+" does not use https, so keys are fetched without encryption", "Change basedomain to an https url")
+	}
+
+	req, err := newAPIRequest(http.MethodHead, server.BaseDomain, nil)
+	if err != nil {
+		d.fail(prefix+"api", err.Error(), "Check the basedomain setting")
+		return false
+	}
+	res, err := apiClient.Do(req)
+	if err != nil {
+		d.fail(prefix+"api", fmt.Sprintf("unable to reach %s: %s", server.BaseDomain, err), "Check the firewall allows outbound connections to the ServerAuth API")
+		return false
+	}
+	res.Body.Close()
+	d.pass(prefix+"api", fmt.Sprintf("%s is reachable", server.BaseDomain))
+
+	d.checkClock(prefix, res.Header.Get("Date"))
+	return true
+}
+
+// checkClock compares the local clock with the Date header from the API.
+func (d *doctor) checkClock(prefix, date string) {
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		d.warn(prefix+"clock", "the API did not report its time, so the clock could not be checked", "")
+		return
+	}
+
+	skew := time.Since(remote).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	// The Date header only has second precision
+	switch {
+	case skew > clockSkewFail:
+		d.fail(prefix+"clock", fmt.Sprintf("the clock is %s out compared with the ServerAuth API", skew), "Enable time synchronisation, e.g. `timedatectl set-ntp true`")
+	case skew > clockSkewWarn:
+		d.warn(prefix+"clock", fmt.Sprintf("the clock is %s out compared with the ServerAuth API", skew), "Enable time synchronisation, e.g. `timedatectl set-ntp true`")
+	default:
+		d.pass(prefix+"clock", "the clock agrees with the ServerAuth API")
+	}
+}
+
+// checkAccounts checks every account in a profile has valid credentials, a
+// system user and correctly set up files.
+func (d *doctor) checkAccounts(prefix string, v *viper.Viper, server serverConfig) {
+	accounts, err := profileAccounts(v, server.Profile)
+	if err != nil {
+		d.fail(prefix+"accounts", err.Error(), "Run `serverauth config validate` for details")
+		return
+	}
+	if len(accounts) == 0 && !v.GetBool(profileKey(server.Profile, "team.enabled")) {
+		d.warn(prefix+"accounts", "no accounts are configured", "Add one with `serverauth add --username <user> --apikey <key>`")
+		return
+	}
+
+	for _, account := range accounts {
+		name := prefix + "account " + account.Username
+
+		resolved, err := resolveAccountKey(account)
+		if err == nil {
+			var keys string
+			if keys, err = fetchAccountKeys(server, resolved); err == nil {
+				d.pass(name+" credentials", fmt.Sprintf("the API key is valid and provides %d key(s)", countKeys(keys)))
+			}
+		}
+		if err != nil {
+			d.fail(name+" credentials", err.Error(), "Check the account's API key on your ServerAuth control panel, and the server's orgid and apikey")
+		}
+
+		u, err := user.Lookup(account.Username)
+		if err != nil {
+			hint := "Create the user, or set `createUser: true` on the account to have sync create it"
+			if account.CreateUser {
+				hint = "Run `serverauth sync` to create it"
+			}
+			d.fail(name+" user", fmt.Sprintf("the system user %s does not exist", account.Username), hint)
+			continue
+		}
+		d.pass(name+" user", fmt.Sprintf("the system user exists, with home %s", u.HomeDir))
+
+		d.checkKeysFiles(name, u)
+	}
+}
+
+// checkKeysFiles checks the ownership and modes sshd's StrictModes expects
+// of a user's .ssh directory and authorized_keys file.
+func (d *doctor) checkKeysFiles(name string, u *user.User) {
+	sshPath := filepath.Join(u.HomeDir, ".ssh")
+	keysPath := filepath.Join(sshPath, "authorized_keys")
+	hint := fmt.Sprintf("Run `chown %[1]s %[2]s %[3]s && chmod 700 %[2]s && chmod 600 %[3]s`", u.Username, sshPath, keysPath)
+
+	for _, path := range []string{sshPath, keysPath} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				d.warn(name+" files", path+" does not exist yet", "Run `serverauth sync`")
+			} else {
+				d.fail(name+" files", err.Error(), "")
+			}
+			return
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			d.fail(name+" files", path+" is a symbolic link, which ServerAuth will not follow", "Replace it with a real file or directory")
+			return
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			d.fail(name+" files", fmt.Sprintf("%s has mode %04o, so sshd will ignore the keys", path, info.Mode().Perm()), hint)
+			return
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && fmt.Sprint(st.Uid) != u.Uid {
+			d.fail(name+" files", fmt.Sprintf("%s is not owned by %s", path, u.Username), hint)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		d.fail(name+" files", err.Error(), "")
+		return
+	}
+	if !validKeysFile(string(data)) {
+		d.warn(name+" files", keysPath+" has not been written by ServerAuth yet", "Run `serverauth sync`")
+		return
+	}
+
+	d.pass(name+" files", keysPath+" is managed by ServerAuth, with the correct owner and mode")
+}
+
+// checkSSHD checks sshd will use the authorized_keys files ServerAuth writes.
+func (d *doctor) checkSSHD() {
+	out, err := exec.Command("sshd", "-T").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		d.warn("sshd", fmt.Sprintf("unable to read the sshd settings: %s", err), "Run `sshd -T` as root to check the sshd configuration")
+		return
+	}
+
+	settings := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.SplitN(strings.TrimSpace(line), " ", 2); len(fields) == 2 {
+			settings[fields[0]] = fields[1]
+		}
+	}
+
+	if settings["pubkeyauthentication"] == "no" {
+		d.fail("sshd", "PubkeyAuthentication is disabled, so SSH keys cannot be used to log in", "Set `PubkeyAuthentication yes` in /etc/ssh/sshd_config and reload sshd")
+		return
+	}
+
+	files := strings.Fields(settings["authorizedkeysfile"])
+	found := false
+	for _, file := range files {
+		if file == ".ssh/authorized_keys" || file == "%h/.ssh/authorized_keys" {
+			found = true
+		}
+	}
+	if len(files) > 0 && !found {
+		d.fail("sshd", "AuthorizedKeysFile is set to "+strings.Join(files, " ")+", so the keys ServerAuth installs are not used", "Add .ssh/authorized_keys to AuthorizedKeysFile in /etc/ssh/sshd_config and reload sshd")
+		return
+	}
+
+	d.pass("sshd", "public key logins are enabled and use .ssh/authorized_keys")
+}
+
+// checkSchedule checks sync and monitor are scheduled with systemd or cron.
+func (d *doctor) checkSchedule() {
+	hint := "Run `serverauth init` to schedule the agent"
+
+	if _, err := os.Stat(filepath.Join(systemdUnitDir, "serverauth-sync.timer")); err == nil {
+		var inactive []string
+		for _, timer := range []string{"serverauth-sync.timer", "serverauth-monitor.timer"} {
+			if err := exec.Command("systemctl", "is-active", "--quiet", timer).Run(); err != nil {
+				inactive = append(inactive, timer)
+			}
+		}
+		if len(inactive) > 0 {
+			d.fail("schedule", strings.Join(inactive, " and ")+" not active", "Run `systemctl enable --now "+strings.Join(inactive, " ")+"`")
+			return
+		}
+		d.pass("schedule", "the systemd timers are active")
+		return
+	}
+
+	if _, err := os.Stat(cronFile); err == nil {
+		d.pass("schedule", "sync and monitor are scheduled in "+cronFile)
+		return
+	}
+
+	d.fail("schedule", "neither the systemd timers nor the cron jobs are installed, so keys are not kept up to date", hint)
+}
+
+// checkLastSync checks sync has run recently and succeeded.
+func (d *doctor) checkLastSync() {
+	var record syncRecord
+	if err := readState(lastSyncFile, &record); err != nil {
+		d.fail("last sync", err.Error(), "")
+		return
+	}
+	if record.FinishedAt.IsZero() {
+		d.warn("last sync", "no sync has been recorded", "Run `serverauth sync`")
+		return
+	}
+
+	age := time.Since(record.FinishedAt).Round(time.Second)
+	message := fmt.Sprintf("the last sync finished %s ago", age)
+	switch {
+	case age > lastSyncFailAge:
+		d.fail("last sync", message, "Check the schedule, and the output of `serverauth sync`")
+	case record.Failed:
+		d.warn("last sync", message+", but some accounts failed", "Run `serverauth sync` to see the errors")
+	case age > lastSyncWarnAge:
+		d.warn("last sync", message, "Check the schedule, and the output of `serverauth sync`")
+	default:
+		d.pass("last sync", message)
+	}
+}
+
+// printDoctorReport prints each check with its status and hint.
+func printDoctorReport(report doctorReport) {
+	labels := map[doctorStatus]string{
+		doctorPass: color.GreenString("PASS"),
+		doctorWarn: color.YellowString("WARN"),
+		doctorFail: color.RedString("FAIL"),
+	}
+
+	for _, check := range report.Checks {
+		fmt.Printf("[%s] %s: %s\n", labels[check.Status], check.Name, check.Message)
+		if check.Status != doctorPass && len(check.Hint) > 0 {
+			fmt.Printf("       %s\n", check.Hint)
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d warnings, %d failed\n", report.Summary[doctorPass], report.Summary[doctorWarn], report.Summary[doctorFail])
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Print the results as JSON")
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SymlinkError is returned when a path inside a user's home directory turns
+// out to be a symbolic link. The agent runs as root, so following a link
+// planted by the user could let them overwrite any file on the system.
+type SymlinkError struct {
+	Path string
+}
+
+func (e *SymlinkError) Error() string {
+	return fmt.Sprintf("security error: %s is a symbolic link and will not be followed", e.Path)
+}
+
+// sshDir is an open handle on a user's ~/.ssh directory. Every operation is
+// performed relative to the directory's file descriptor with O_NOFOLLOW, so
+// the directory or its files cannot be swapped for a symlink mid-way.
+type sshDir struct {
+	path string
+	fd   int
+	uid  int
+	gid  int
+}
+
+// openSSHDir opens the .ssh directory of the given user, creating it (owned
+// by the user, mode 0700) when create is set and it does not yet exist.
+func openSSHDir(u *user.User, create bool) (*sshDir, error) {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for %s: %v", u.Username, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid for %s: %v", u.Username, err)
+	}
+
+	// The home directory itself comes from the passwd database, which only
+	// root can change, so it is opened normally.
+	homeFd, err := unix.Open(u.HomeDir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: u.HomeDir, Err: err}
+	}
+	defer unix.Close(homeFd)
+
+	path := filepath.Join(u.HomeDir, ".ssh")
+
+	if err := checkNotSymlink(homeFd, ".ssh", path); err != nil {
+		if !os.IsNotExist(err) || !create {
+			return nil, err
+		}
+
+		if err := unix.Mkdirat(homeFd, ".ssh", 0700); err != nil && err != unix.EEXIST {
+			return nil, &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+	}
+
+	fd, err := unix.Openat(homeFd, ".ssh", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, openatError(homeFd, ".ssh", path, err)
+	}
+
+	d := &sshDir{path: path, fd: fd, uid: uid, gid: gid}
+
+	// Make sure the directory belongs to the user, so sshd's StrictModes
+	// check accepts it. This is done through the descriptor, not the path.
+	if err := unix.Fchown(fd, uid, gid); err != nil {
+		d.Close()
+		return nil, &os.PathError{Op: "chown", Path: path, Err: err}
+	}
+
+	return d, nil
+}
+
+// Close releases the directory descriptor.
+func (d *sshDir) Close() error {
+	return unix.Close(d.fd)
+}
+
+// Path returns the full path of a file inside the directory, for messages.
+func (d *sshDir) Path(name string) string {
+	return filepath.Join(d.path, name)
+}
+
+// Exists reports whether name exists as a regular file in the directory.
+func (d *sshDir) Exists(name string) (bool, error) {
+	if err := checkNotSymlink(d.fd, name, d.Path(name)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ReadFile returns the contents of name, refusing to follow symlinks.
+func (d *sshDir) ReadFile(name string) ([]byte, error) {
+	f, err := d.open(name, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile atomically replaces name with data. The contents are written to
+// a temporary file owned by the user, synced, and renamed over the target.
+func (d *sshDir) WriteFile(name string, data []byte, perm uint32) error {
+	if err := d.refuseSymlink(name); err != nil {
+		return err
+	}
+
+	tmpName := fmt.Sprintf(".%s.serverauth-%d-%d", name, os.Getpid(), time.Now().UnixNano())
+	f, err := d.open(tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	err = writeSyncChown(f, data, d.uid, d.gid)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = unix.Renameat(d.fd, tmpName, d.fd, name)
+	}
+	if err != nil {
+		unix.Unlinkat(d.fd, tmpName, 0)
+		return &os.PathError{Op: "write", Path: d.Path(name), Err: err}
+	}
+
+	return unix.Fsync(d.fd)
+}
+
+// Rename moves oldName to newName within the directory. Neither may be a
+// symlink.
+func (d *sshDir) Rename(oldName, newName string) error {
+	if err := d.refuseSymlink(oldName); err != nil {
+		return err
+	}
+	if err := d.refuseSymlink(newName); err != nil {
+		return err
+	}
+
+	if err := unix.Renameat(d.fd, oldName, d.fd, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: d.Path(oldName), New: d.Path(newName), Err: err}
+	}
+	return nil
+}
+
+// Remove deletes name from the directory. Unlinking a symlink never touches
+// its target, so no check is needed beyond the name staying inside the
+// directory.
+func (d *sshDir) Remove(name string) error {
+	if err := unix.Unlinkat(d.fd, name, 0); err != nil {
+		return &os.PathError{Op: "remove", Path: d.Path(name), Err: err}
+	}
+	return nil
+}
+
+// open opens name relative to the directory with O_NOFOLLOW set and
+// verifies the result is a regular file.
+func (d *sshDir) open(name string, flags int, perm uint32) (*os.File, error) {
+	path := d.Path(name)
+
+	fd, err := unix.Openat(d.fd, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm)
+	if err != nil {
+		return nil, openatError(d.fd, name, path, err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		unix.Close(fd)
+		return nil, fmt.Errorf("security error: %s is not a regular file", path)
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// refuseSymlink returns a SymlinkError if name exists and is a symlink. A
+// missing file is not an error.
+func (d *sshDir) refuseSymlink(name string) error {
+	if err := checkNotSymlink(d.fd, name, d.Path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkNotSymlink lstat's name relative to dirFd and returns a SymlinkError
+// if it is a link.
+func checkNotSymlink(dirFd int, name, path string) error {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirFd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return &SymlinkError{Path: path}
+	}
+	return nil
+}
+
+// openatError converts a failed O_NOFOLLOW open into a SymlinkError when the
+// target was a link, which different kernels report with different errnos.
+func openatError(dirFd int, name, path string, err error) error {
+	if symErr := checkNotSymlink(dirFd, name, path); symErr != nil {
+		var linkErr *SymlinkError
+		if errors.As(symErr, &linkErr) {
+			return symErr
+		}
+	}
+	return &os.PathError{Op: "open", Path: path, Err: err}
+}
+
+// writeSyncChown writes data to f, hands ownership to uid/gid and flushes it
+// to disk.
+func writeSyncChown(f *os.File, data []byte, uid, gid int) error {
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		return err
+	}
+	return f.Sync()
+}
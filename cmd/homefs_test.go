@@ -0,0 +1,144 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testHomeUser returns the current user with a fresh, empty home directory.
+func testHomeUser(t *testing.T) *user.User {
+	t.Helper()
+	return &user.User{
+		Username: "test",
+		Uid:      strconv.Itoa(os.Getuid()),
+		Gid:      strconv.Itoa(os.Getgid()),
+		HomeDir:  t.TempDir(),
+	}
+}
+
+func TestOpenSSHDirRefusesSymlinkedDirectory(t *testing.T) {
+	u := testHomeUser(t)
+	target := t.TempDir()
+	if err := os.Symlink(target, filepath.Join(u.HomeDir, ".ssh")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, create := range []bool{false, true} {
+		d, err := openSSHDir(u, create)
+		if err == nil {
+			d.Close()
+		}
+		var linkErr *SymlinkError
+		if !errors.As(err, &linkErr) {
+			t.Errorf("openSSHDir(create=%v) error = %v, want a SymlinkError", create, err)
+		}
+	}
+}
+
+func TestSSHDirRefusesSymlinkedFile(t *testing.T) {
+	u := testHomeUser(t)
+	d, err := openSSHDir(u, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	target := filepath.Join(t.TempDir(), "shadow")
+	if err := ioutil.WriteFile(target, []byte("original\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, d.Path("authorized_keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	var linkErr *SymlinkError
+	if err := d.WriteFile("authorized_keys", []byte("ssh-ed25519 AAAA\n"), 0600); !errors.As(err, &linkErr) {
+		t.Errorf("WriteFile() error = %v, want a SymlinkError", err)
+	}
+	if _, err := d.ReadFile("authorized_keys"); !errors.As(err, &linkErr) {
+		t.Errorf("ReadFile() error = %v, want a SymlinkError", err)
+	}
+	if err := d.Rename("authorized_keys", "authorized_keys.bak"); !errors.As(err, &linkErr) {
+		t.Errorf("Rename() error = %v, want a SymlinkError", err)
+	}
+
+	if data, _ := ioutil.ReadFile(target); string(data) != "original\n" {
+		t.Errorf("the symlink target was changed to %q", data)
+	}
+}
+
+func TestSSHDirWriteFileReplacesAtomically(t *testing.T) {
+	u := testHomeUser(t)
+	d, err := openSSHDir(u, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.WriteFile("authorized_keys", []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(d.Path("authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.WriteFile("authorized_keys", []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(d.Path("authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := d.ReadFile("authorized_keys"); string(data) != "new\n" {
+		t.Errorf("ReadFile() = %q, want %q", data, "new\n")
+	}
+
+	// The new contents are renamed into place rather than written over the
+	// old file, so a reader never sees a partly written file
+	if before.Sys().(*syscall.Stat_t).Ino == after.Sys().(*syscall.Stat_t).Ino {
+		t.Error("WriteFile() wrote over the existing file instead of replacing it")
+	}
+	if after.Mode().Perm() != 0600 {
+		t.Errorf("authorized_keys mode = %v, want 0600", after.Mode().Perm())
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(u.HomeDir, ".ssh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".serverauth-") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"runtime"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/load"
+)
+
+// hostIdentity identifies the server for every payload, whichever
+// collectors are enabled.
+func hostIdentity() (metrics.Host, error) {
+	identity := metrics.Host{OS: runtime.GOOS, Arch: runtime.GOARCH}
+
+	var err error
+	if identity.Hostname, err = os.Hostname(); err != nil {
+		return identity, err
+	}
+	identity.ID, err = host.HostID()
+	return identity, err
+}
+
+// hostCollector reports the operating system and uptime
+type hostCollector struct{}
+
+func (hostCollector) Name() string { return "host" }
+
+func (hostCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	system := &metrics.System{}
+	p.System = system
+
+	var err error
+	if system.Platform, system.PlatformFamily, system.PlatformVersion, err = host.PlatformInformationWithContext(ctx); err != nil {
+		return err
+	}
+	if system.KernelVersion, err = host.KernelVersionWithContext(ctx); err != nil {
+		return err
+	}
+	system.UptimeSeconds, err = host.UptimeWithContext(ctx)
+	return err
+}
+
+// timeCollector reports the server's time zone
+type timeCollector struct{}
+
+func (timeCollector) Name() string { return "time" }
+
+func (timeCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	zone, offset := p.CollectedAt.Zone()
+	p.Time = &metrics.Time{Timezone: zone, UTCOffsetSeconds: offset}
+	return nil
+}
+
+// loadCollector reports the load average and counts processes by state
+type loadCollector struct{}
+
+func (loadCollector) Name() string { return "load" }
+
+func (loadCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	p.Load = &metrics.Load{Load1: avg.Load1, Load5: avg.Load5, Load15: avg.Load15}
+
+	misc, err := load.MiscWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	p.Processes = &metrics.Processes{Running: misc.ProcsRunning, Blocked: misc.ProcsBlocked, Total: misc.ProcsTotal}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var enrollToken string
+var enrollBaseDomain string
+var scheduler string
+var syncInterval time.Duration
+var monitorInterval time.Duration
+var forceEnroll bool
+
+// systemdUnitDir is where the agent's systemd units are installed
+var systemdUnitDir = "/etc/systemd/system"
+
+// cronFile is used to schedule the agent on systems without systemd
+var cronFile = "/etc/cron.d/serverauth"
+
+// enrollRequest is sent to the API to exchange an enrollment token
+type enrollRequest struct {
+	Token    string `json:"token"`
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+}
+
+// enrollResponse holds the credentials issued for this server
+type enrollResponse struct {
+	OrgID   string `json:"orgid"`
+	APIKey  string `json:"apikey"`
+	TeamKey string `json:"teamkey"`
+}
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Enroll this server with ServerAuth",
+	Long: `Exchange an enrollment token for this server's ServerAuth credentials, write the config file and schedule the agent.
+
+The command is safe to run more than once, e.g. from cloud-init. A server that is already enrolled keeps its credentials unless --force is given.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		readConfig()
+
+		enrolled := len(viper.GetString("orgid")) > 0 && len(viper.GetString("apikey")) > 0 && len(viper.GetString("teamkey")) > 0
+
+		if enrolled && !forceEnroll {
+			color.Green("This server is already enrolled with ServerAuth. Use --force to enroll it again.")
+		} else {
+			if len(enrollToken) == 0 {
+				color.Red("An enrollment token is required. You can find it on the server details page inside your ServerAuth account.")
+				os.Exit(1)
+			}
+
+			baseDomain := enrollBaseDomain
+			if len(baseDomain) == 0 {
+				baseDomain = viper.GetString("basedomain")
+			}
+			if len(baseDomain) == 0 {
+				baseDomain = defaultBaseDomain
+			}
+
+			color.Green("Enrolling this server with ServerAuth.")
+			credentials, err := exchangeEnrollToken(baseDomain, enrollToken)
+			if err != nil {
+				color.Red("Unable to enroll this server: %s", err)
+				os.Exit(1)
+			}
+
+			err = updateConfig(func(root *yaml.Node) error {
+				setMappingString(root, "orgid", credentials.OrgID)
+				setMappingString(root, "apikey", credentials.APIKey)
+				setMappingString(root, "teamkey", credentials.TeamKey)
+				if len(enrollBaseDomain) > 0 {
+					setMappingString(root, "basedomain", enrollBaseDomain)
+				}
+				return nil
+			})
+			if err == nil {
+				// The config holds the server's credentials, so only root may read it
+				err = os.Chmod(configFile(), 0600)
+			}
+			if err != nil {
+				color.Red("Unable to write the ServerAuth config: %s", err)
+				os.Exit(1)
+			}
+
+			color.Green("The server has been enrolled, and the config written to %s", configFile())
+		}
+
+		if err := installSchedule(scheduler); err != nil {
+			color.Red("Unable to schedule the agent: %s", err)
+			os.Exit(1)
+		}
+
+		// Run everything once now, rather than waiting for the schedule
+		failed := false
+		for _, command := range []string{"sync", "monitor"} {
+			color.Green("Running the first %s.", command)
+			if err := runAgentCommand(command); err != nil {
+				color.Red("The first %s failed: %s", command, err)
+				failed = true
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// exchangeEnrollToken trades an enrollment token for the server's credentials.
+func exchangeEnrollToken(baseDomain, token string) (*enrollResponse, error) {
+	hostname, _ := os.Hostname()
+
+	body, err := json.Marshal(enrollRequest{
+		Token:    token,
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := newAPIRequest(http.MethodPost, baseDomain+"enroll", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, errors.New("the enrollment token is invalid or has expired")
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &APIError{URL: req.URL.String(), StatusCode: res.StatusCode}
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials enrollResponse
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("the response from the ServerAuth api was invalid: %v", err)
+	}
+	if len(credentials.OrgID) == 0 || len(credentials.APIKey) == 0 || len(credentials.TeamKey) == 0 {
+		return nil, errors.New("the response from the ServerAuth api was missing the server credentials")
+	}
+
+	return &credentials, nil
+}
+
+// installSchedule makes sure sync and monitor run regularly, using systemd
+// timers where available and cron otherwise.
+func installSchedule(scheduler string) error {
+	if scheduler == "auto" {
+		scheduler = "cron"
+		if _, err := os.Stat("/run/systemd/system"); err == nil {
+			scheduler = "systemd"
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The scheduled runs are given the same config file as init
+	args, err := configArgs()
+	if err != nil {
+		return err
+	}
+	for _, arg := range append([]string{executable}, args...) {
+		if strings.ContainsAny(arg, " \t\n'\"\\%") {
+			return fmt.Errorf("%q can't be used in a schedule, as it has spaces, quotes or %% in it", arg)
+		}
+	}
+	if len(args) > 0 {
+		executable += " " + strings.Join(args, " ")
+	}
+
+	switch scheduler {
+	case "systemd":
+		return installSystemdUnits(executable)
+	case "cron":
+		return installCronFile(executable)
+	case "none":
+		return nil
+	}
+	return fmt.Errorf("unknown scheduler %q, expected auto, systemd, cron or none", scheduler)
+}
+
+// installSystemdUnits writes a service and timer for sync and monitor, and
+// enables the timers. executable includes any --config flag.
+func installSystemdUnits(executable string) error {
+	changed := false
+	for command, interval := range map[string]time.Duration{"sync": syncInterval, "monitor": monitorInterval} {
+		service := fmt.Sprintf(`[Unit]
+Description=ServerAuth agent %[1]s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%[2]s %[1]s
+`, command, executable)
+
+		timer := fmt.Sprintf(`[Unit]
+Description=Run the ServerAuth agent %[1]s regularly
+
+[Timer]
+OnBootSec=1min
+OnUnitActiveSec=%[2]ds
+
+[Install]
+WantedBy=timers.target
+`, command, int(interval.Seconds()))
+
+		for name, contents := range map[string]string{"serverauth-" + command + ".service": service, "serverauth-" + command + ".timer": timer} {
+			written, err := writeIfChanged(systemdUnitDir+"/"+name, []byte(contents), 0644)
+			if err != nil {
+				return err
+			}
+			changed = changed || written
+		}
+	}
+
+	if changed {
+		if err := runSystemCommand("systemctl", "daemon-reload"); err != nil {
+			return err
+		}
+		color.Green("Installed the ServerAuth systemd timers.")
+	}
+
+	return runSystemCommand("systemctl", "enable", "--now", "serverauth-sync.timer", "serverauth-monitor.timer")
+}
+
+// installCronFile schedules sync and monitor with cron. executable includes
+// any --config flag.
+func installCronFile(executable string) error {
+	contents := fmt.Sprintf(`# This file is managed by ServerAuth.
+SHELL=/bin/sh
+PATH=/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin
+
+%s root %s sync >/dev/null 2>&1
+%s root %s monitor >/dev/null 2>&1
+`, cronSchedule(syncInterval), executable, cronSchedule(monitorInterval), executable)
+
+	written, err := writeIfChanged(cronFile, []byte(contents), 0644)
+	if written {
+		color.Green("Installed the ServerAuth cron jobs in %s.", cronFile)
+	}
+	return err
+}
+
+// cronSchedule converts an interval into a cron schedule, to the nearest minute.
+func cronSchedule(interval time.Duration) string {
+	minutes := int(interval.Minutes())
+	if minutes <= 1 {
+		return "* * * * *"
+	}
+	if minutes >= 60 {
+		return "0 * * * *"
+	}
+	return fmt.Sprintf("*/%d * * * *", minutes)
+}
+
+// writeIfChanged writes a file only if its contents differ, reporting
+// whether anything was written.
+func writeIfChanged(path string, contents []byte, perm os.FileMode) (bool, error) {
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, contents) {
+		return false, nil
+	}
+
+	return true, writeFileAtomic(path, contents, perm)
+}
+
+// configArgs returns the --config flag that makes another run of the agent
+// use the same config file, or nothing for the default config file.
+func configArgs() ([]string, error) {
+	path := configFile()
+	if path == defaultConfigFile {
+		return nil, nil
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"--config", abs}, nil
+}
+
+// runAgentCommand runs another agent command as a child process, with the
+// same config file.
+func runAgentCommand(command string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args, err := configArgs()
+	if err != nil {
+		return err
+	}
+
+	child := exec.Command(executable, append([]string{command}, args...)...)
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	return child.Run()
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+
+	initCmd.Flags().StringVarP(&enrollToken, "token", "t", "", "The enrollment token from your ServerAuth account")
+	initCmd.Flags().StringVar(&enrollBaseDomain, "basedomain", "", "Override the ServerAuth API url")
+	initCmd.Flags().StringVar(&scheduler, "scheduler", "auto", "How to schedule the agent: auto, systemd, cron or none")
+	initCmd.Flags().DurationVar(&syncInterval, "sync-interval", time.Minute, "How often to sync SSH keys")
+	initCmd.Flags().DurationVar(&monitorInterval, "monitor-interval", time.Minute, "How often to send monitoring metrics")
+	initCmd.Flags().BoolVar(&forceEnroll, "force", false, "Enroll again, even if the server already has credentials")
+}
@@ -0,0 +1,541 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/spf13/viper"
+)
+
+// The places the logins collector can read sshd's logs from
+const (
+	loginSourceAuto    = "auto"
+	loginSourceFile    = "file"
+	loginSourceJournal = "journal"
+)
+
+// authLogFiles are where syslog writes sshd's messages on Debian and Ubuntu,
+// and on RHEL and its derivatives
+var authLogFiles = []string{"/var/log/auth.log", "/var/log/secure"}
+
+// authLogStateFile keeps how far the auth log has been read
+const authLogStateFile = "auth-log.json"
+
+// sshdJournalStateFile keeps how far the journal has been read
+const sshdJournalStateFile = "sshd-journal.json"
+
+// maxLoginEvents is as many logins as are sent at once. Any more are read on
+// the next run.
+const maxLoginEvents = 1000
+
+// syslogTimeLayout is the traditional syslog timestamp, which has no year
+const syslogTimeLayout = "Jan _2 15:04:05"
+
+// sshdPrograms are the names sshd logs under. OpenSSH 9.8 moved logins into
+// a separate sshd-session program.
+var sshdPrograms = []string{"sshd", "sshd-session"}
+
+// sshdLoginPattern matches the messages sshd logs when a login is accepted
+// or fails, e.g.
+//
+//	Accepted publickey for alice from 192.0.2.1 port 50412 ssh2: ED25519 SHA256:...
+//	Failed password for invalid user admin from 192.0.2.1 port 50412 ssh2
+var sshdLoginPattern = regexp.MustCompile(`^(Accepted|Failed) (\S+) for (invalid user )?(.*) from (\S+) port (\d+) ssh2(?:: (\S+) (\S+))?`)
+
+// authLogHeadSize is how much of the start of the auth log is remembered to
+// notice when it has been truncated
+const authLogHeadSize = 512
+
+// authLogPosition is the contents of the auth log state file. The inode
+// shows when the log has been rotated, and stays that of the rotated log
+// until all of it has been read. Head is a hash of the start of the log,
+// which shows when it has been truncated in place.
+type authLogPosition struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	Head   string `json:"head,omitempty"`
+}
+
+// journalPosition is the contents of the journal state file. Since is used
+// until there is a cursor to carry on from.
+type journalPosition struct {
+	Cursor string    `json:"cursor,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// journalEntry is the part of an entry from journalctl --output=json that
+// is needed to read a login
+type journalEntry struct {
+	Cursor     string          `json:"__CURSOR"`
+	Realtime   string          `json:"__REALTIME_TIMESTAMP"`
+	Identifier string          `json:"SYSLOG_IDENTIFIER"`
+	PID        string          `json:"_PID"`
+	Message    json.RawMessage `json:"MESSAGE"`
+}
+
+// loginsCollector reports the SSH logins that have been accepted or have
+// failed since the previous run, read from the auth log or the journal
+type loginsCollector struct{}
+
+func (loginsCollector) Name() string { return "logins" }
+
+func (loginsCollector) Settings() map[string]*schemaField {
+	return map[string]*schemaField{
+		"source": {Kind: kindString, Check: checkOneOf(loginSourceAuto, loginSourceFile, loginSourceJournal)},
+		"path":   {Kind: kindString, Check: checkAbsolutePath},
+	}
+}
+
+func (c loginsCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	source := viper.GetString(collectorKey(c.Name(), "source"))
+	path := viper.GetString(collectorKey(c.Name(), "path"))
+	if source == "" || source == loginSourceAuto {
+		source, path = detectLoginSource(path)
+	}
+
+	var err error
+	switch source {
+	case loginSourceFile:
+		if path == "" {
+			if path = findAuthLog(); path == "" {
+				return fmt.Errorf("no auth log found in %s, please set the path", strings.Join(authLogFiles, " or "))
+			}
+		}
+		var pos authLogPosition
+		if p.Logins, pos, err = readAuthLog(path, p.CollectedAt); err == nil {
+			state[authLogStateFile] = pos
+		}
+	case loginSourceJournal:
+		var pos journalPosition
+		if p.Logins, pos, err = readSSHDJournal(ctx, p.CollectedAt); err == nil {
+			state[sshdJournalStateFile] = pos
+		}
+	}
+	return err
+}
+
+// detectLoginSource prefers the auth log, which is only written when syslog
+// is installed, and falls back to the journal. Nothing is read on servers
+// that have neither.
+func detectLoginSource(path string) (string, string) {
+	if path != "" {
+		return loginSourceFile, path
+	}
+	if path = findAuthLog(); path != "" {
+		return loginSourceFile, path
+	}
+	if _, err := os.Stat(systemdRunDir); err == nil {
+		if _, err := exec.LookPath("journalctl"); err == nil {
+			return loginSourceJournal, ""
+		}
+	}
+	return "", ""
+}
+
+// findAuthLog returns the first of authLogFiles that exists.
+func findAuthLog() string {
+	for _, path := range authLogFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// readAuthLog reads the logins added to an auth log since the previous run,
+// returning them with the position to save for the next run. The first time
+// a log is read only its position is returned, so that logins from before the
+// agent was set up aren't sent.
+func readAuthLog(path string, now time.Time) ([]metrics.LoginEvent, authLogPosition, error) {
+	var pos authLogPosition
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, pos, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, pos, err
+	}
+
+	if err := readState(authLogStateFile, &pos); err != nil {
+		return nil, pos, err
+	}
+	if pos.Path != path {
+		head, err := authLogHead(file, info.Size())
+		return nil, authLogPosition{Path: path, Inode: fileInode(info), Offset: info.Size(), Head: head}, err
+	}
+
+	events := []metrics.LoginEvent{}
+
+	// After the log is rotated, the rest of the old log is read from wherever
+	// it was moved to before starting on the new one. When there are more
+	// logins left than can be sent at once, the rest are read next time.
+	if pos.Inode != fileInode(info) {
+		found, read, drained, err := readRotatedAuthLog(path, pos, now, maxLoginEvents)
+		events = append(events, found...)
+		if err != nil {
+			return events, pos, err
+		}
+		if !drained {
+			pos.Offset += read
+			return events, pos, nil
+		}
+		pos = authLogPosition{Path: path, Inode: fileInode(info)}
+	}
+
+	// A log that is truncated in place, e.g. by logrotate's copytruncate, is
+	// read from the start again. It can have grown back past the offset, so
+	// the start of the log is checked as well as its size.
+	if info.Size() < pos.Offset {
+		pos.Offset = 0
+	} else if pos.Head != "" {
+		head, err := authLogHead(file, pos.Offset)
+		if err != nil {
+			return events, pos, err
+		}
+		if head != pos.Head {
+			pos.Offset = 0
+		}
+	}
+
+	if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+		return events, pos, err
+	}
+	found, read, err := scanAuthLog(file, now, time.Local, maxLoginEvents-len(events))
+	events = append(events, found...)
+	if err != nil {
+		return events, pos, err
+	}
+
+	pos.Offset += read
+	pos.Head, err = authLogHead(file, pos.Offset)
+	return events, pos, err
+}
+
+// readRotatedAuthLog reads the rest of a rotated auth log, which is found
+// by its inode, e.g. as auth.log.1 or secure-20240519, stopping after limit
+// logins. It returns how many bytes were read, and whether the rotated log
+// has been read to the end or is gone. Compressed logs are never still
+// unread, so they are not looked at.
+func readRotatedAuthLog(path string, pos authLogPosition, now time.Time, limit int) ([]metrics.LoginEvent, int64, bool, error) {
+	rotated, err := filepath.Glob(path + "?*")
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	for _, name := range rotated {
+		info, err := os.Stat(name)
+		if err != nil || fileInode(info) != pos.Inode || info.Size() < pos.Offset {
+			continue
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		defer file.Close()
+
+		if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+			return nil, 0, false, err
+		}
+		events, read, err := scanAuthLog(file, now, time.Local, limit)
+		return events, read, len(events) < limit, err
+	}
+
+	return []metrics.LoginEvent{}, 0, true, nil
+}
+
+// authLogHead returns a hash of the start of the auth log, up to size bytes
+// of it, or nothing when size is 0.
+func authLogHead(file *os.File, size int64) (string, error) {
+	if size > authLogHeadSize {
+		size = authLogHeadSize
+	}
+	if size == 0 {
+		return "", nil
+	}
+
+	head := make([]byte, size)
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(head)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fileInode returns the inode of a file, or 0 where there are no inodes.
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// scanAuthLog reads the logins from syslog lines, stopping after limit
+// logins. It returns how many bytes were read, which leaves out a last line
+// that is still being written. Timestamps without a year are read in loc.
+func scanAuthLog(r io.Reader, now time.Time, loc *time.Location, limit int) ([]metrics.LoginEvent, int64, error) {
+	events := []metrics.LoginEvent{}
+	reader := bufio.NewReader(r)
+	var read int64
+
+	for len(events) < limit {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return events, read, err
+		}
+		read += int64(len(line))
+
+		if event, ok := parseAuthLogLine(strings.TrimRight(line, "\r\n"), now, loc); ok {
+			events = append(events, event)
+		}
+	}
+
+	return events, read, nil
+}
+
+// parseAuthLogLine reads a login from a single syslog line, e.g.
+//
+//	May 14 10:03:29 web2 sshd[3590]: Accepted publickey for ...
+//	2024-05-14T09:14:22.904512+00:00 db1 sshd[21044]: Accepted publickey for ...
+//
+// Lines from programs other than sshd, and other sshd messages, are skipped.
+func parseAuthLogLine(line string, now time.Time, loc *time.Location) (metrics.LoginEvent, bool) {
+	var logged time.Time
+	var rest string
+
+	// Newer rsyslog releases write RFC 3339 timestamps, and older ones the
+	// traditional syslog timestamp
+	if space := strings.IndexByte(line, ' '); space > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:space]); err == nil {
+			logged, rest = t, line[space+1:]
+		}
+	}
+	if rest == "" {
+		if len(line) <= len(syslogTimeLayout) {
+			return metrics.LoginEvent{}, false
+		}
+		t, err := time.ParseInLocation(syslogTimeLayout, line[:len(syslogTimeLayout)], loc)
+		if err != nil {
+			return metrics.LoginEvent{}, false
+		}
+		logged, rest = syslogYear(t, now.In(loc)), line[len(syslogTimeLayout)+1:]
+	}
+
+	// The host name comes next, then the program and its pid
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 3 || !strings.HasSuffix(fields[1], ":") {
+		return metrics.LoginEvent{}, false
+	}
+	program, pid := strings.TrimSuffix(fields[1], ":"), 0
+	if open := strings.IndexByte(program, '['); open > 0 && strings.HasSuffix(program, "]") {
+		pid, _ = strconv.Atoi(program[open+1 : len(program)-1])
+		program = program[:open]
+	}
+	if !isSSHD(program) {
+		return metrics.LoginEvent{}, false
+	}
+
+	event, ok := parseSSHDMessage(fields[2])
+	event.Time, event.PID = logged, pid
+	return event, ok
+}
+
+// syslogYear gives a syslog timestamp the year it was most likely logged
+// in. A time more than a day ahead of now was logged last year.
+func syslogYear(t, now time.Time) time.Time {
+	logged := time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	if logged.After(now.Add(24 * time.Hour)) {
+		logged = logged.AddDate(-1, 0, 0)
+	}
+	return logged
+}
+
+// isSSHD reports whether a syslog program name is sshd.
+func isSSHD(program string) bool {
+	for _, name := range sshdPrograms {
+		if program == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSSHDMessage reads a login from an sshd log message.
+func parseSSHDMessage(message string) (metrics.LoginEvent, bool) {
+	match := sshdLoginPattern.FindStringSubmatch(message)
+	if match == nil {
+		return metrics.LoginEvent{}, false
+	}
+
+	event := metrics.LoginEvent{
+		Result:         metrics.LoginFailed,
+		Method:         match[2],
+		InvalidUser:    match[3] != "",
+		User:           match[4],
+		SourceIP:       match[5],
+		KeyType:        match[7],
+		KeyFingerprint: match[8],
+	}
+	if match[1] == "Accepted" {
+		event.Result = metrics.LoginAccepted
+	}
+	event.SourcePort, _ = strconv.Atoi(match[6])
+
+	return event, true
+}
+
+// readSSHDJournal reads sshd's logins from the journal since the previous
+// run, returning them with the position to save for the next run. The first
+// time only the time is returned, so that logins from before the agent was
+// set up aren't sent.
+func readSSHDJournal(ctx context.Context, now time.Time) ([]metrics.LoginEvent, journalPosition, error) {
+	var pos journalPosition
+	if err := readState(sshdJournalStateFile, &pos); err != nil {
+		return nil, pos, err
+	}
+	if pos.Cursor == "" && pos.Since.IsZero() {
+		return nil, journalPosition{Since: now}, nil
+	}
+
+	args := []string{"--output=json", "--no-pager", "--quiet"}
+	for _, program := range sshdPrograms {
+		args = append(args, "--identifier="+program)
+	}
+	if pos.Cursor != "" {
+		args = append(args, "--after-cursor="+pos.Cursor)
+	} else {
+		args = append(args, fmt.Sprintf("--since=@%d", pos.Since.Unix()))
+	}
+
+	errOutput := &limitedBuffer{limit: maxCheckOutput}
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	cmd.Stderr = errOutput
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, pos, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, pos, fmt.Errorf("unable to run journalctl: %v", err)
+	}
+
+	events, cursor, err := scanJournal(output, maxLoginEvents)
+
+	// journalctl is stopped once there are as many logins as can be sent
+	if len(events) >= maxLoginEvents {
+		cmd.Process.Kill()
+	}
+	if waitErr := cmd.Wait(); waitErr != nil && len(events) < maxLoginEvents && err == nil {
+		err = fmt.Errorf("journalctl failed: %v %s", waitErr, strings.TrimSpace(errOutput.String()))
+	}
+	if err != nil {
+		return nil, pos, err
+	}
+
+	if cursor != "" {
+		pos.Cursor = cursor
+	}
+	return events, pos, nil
+}
+
+// scanJournal reads the logins from the output of journalctl --output=json,
+// stopping after limit logins. It returns the cursor of the last entry read.
+func scanJournal(r io.Reader, limit int) ([]metrics.LoginEvent, string, error) {
+	events := []metrics.LoginEvent{}
+	cursor := ""
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for len(events) < limit && scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return events, cursor, fmt.Errorf("unable to read the journal: %v", err)
+		}
+		cursor = entry.Cursor
+
+		if event, ok := entry.login(); ok {
+			events = append(events, event)
+		}
+	}
+
+	return events, cursor, scanner.Err()
+}
+
+// login reads a login from a journal entry.
+func (e journalEntry) login() (metrics.LoginEvent, bool) {
+	if !isSSHD(e.Identifier) {
+		return metrics.LoginEvent{}, false
+	}
+
+	event, ok := parseSSHDMessage(e.message())
+	if !ok {
+		return event, false
+	}
+
+	if usec, err := strconv.ParseInt(e.Realtime, 10, 64); err == nil {
+		event.Time = time.Unix(0, usec*int64(time.Microsecond)).UTC()
+	}
+	event.PID, _ = strconv.Atoi(e.PID)
+
+	return event, true
+}
+
+// message returns the entry's message. The journal writes a message that
+// isn't valid UTF-8 as an array of bytes rather than a string.
+func (e journalEntry) message() string {
+	var message string
+	if err := json.Unmarshal(e.Message, &message); err == nil {
+		return message
+	}
+
+	var bytes []byte
+	var values []int
+	if err := json.Unmarshal(e.Message, &values); err == nil {
+		for _, value := range values {
+			bytes = append(bytes, byte(value))
+		}
+	}
+	return string(bytes)
+}
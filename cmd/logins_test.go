@@ -0,0 +1,239 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+)
+
+// loginFixtureTime is when the login fixtures are read, which gives their
+// syslog timestamps a year
+var loginFixtureTime = time.Date(2024, time.June, 10, 12, 0, 0, 0, time.UTC)
+
+// Every auth log and journal fixture in testdata/logins holds sshd and
+// other messages as a distribution writes them, as a <name>.log or
+// <name>.journal file, with the logins it must give in <name>.expected.json.
+func TestLoginFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "logins", "*.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tested := 0
+	for _, fixture := range fixtures {
+		ext := filepath.Ext(fixture)
+		if ext != ".log" && ext != ".journal" {
+			continue
+		}
+		tested++
+
+		t.Run(filepath.Base(fixture), func(t *testing.T) {
+			file, err := os.Open(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var events []metrics.LoginEvent
+			if ext == ".log" {
+				var read int64
+				events, read, err = scanAuthLog(file, loginFixtureTime, time.UTC, maxLoginEvents)
+				if info, _ := file.Stat(); err == nil && read != info.Size() {
+					t.Errorf("scanAuthLog() read %d bytes, want %d", read, info.Size())
+				}
+			} else {
+				events, _, err = scanJournal(file, maxLoginEvents)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.MarshalIndent(events, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := ioutil.ReadFile(strings.TrimSuffix(fixture, ext) + ".expected.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(got)) != strings.TrimSpace(string(expected)) {
+				t.Errorf("logins =\n%s\nwant\n%s", got, expected)
+			}
+		})
+	}
+
+	if tested == 0 {
+		t.Fatal("no login fixtures found")
+	}
+}
+
+func TestParseAuthLogLineYear(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		now  time.Time
+		want time.Time
+	}{
+		{"this year", "Jun  3 08:04:17", loginFixtureTime, time.Date(2024, time.June, 3, 8, 4, 17, 0, time.UTC)},
+		{"last year", "Dec 31 23:59:59", time.Date(2025, time.January, 1, 0, 0, 5, 0, time.UTC), time.Date(2024, time.December, 31, 23, 59, 59, 0, time.UTC)},
+		{"clock behind", "Jun 10 13:00:00", loginFixtureTime, time.Date(2024, time.June, 10, 13, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := tt.line + " web2 sshd[3321]: Accepted password for admin from 192.0.2.50 port 49822 ssh2"
+			event, ok := parseAuthLogLine(line, tt.now, time.UTC)
+			if !ok {
+				t.Fatalf("parseAuthLogLine(%q) found no login", line)
+			}
+			if !event.Time.Equal(tt.want) {
+				t.Errorf("parseAuthLogLine(%q) time = %s, want %s", line, event.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanAuthLogStopsAtLimitAndPartialLine(t *testing.T) {
+	const accepted = "Jun  3 08:20:49 app1 sshd[101402]: Accepted password for ubuntu from 192.0.2.14 port 50022 ssh2\n"
+	const noise = "Jun  3 08:35:12 app1 sudo: pam_unix(sudo:session): session closed for user root\n"
+
+	// A line still being written is left for the next run
+	log := noise + accepted + accepted[:40]
+	events, read, err := scanAuthLog(strings.NewReader(log), loginFixtureTime, time.UTC, maxLoginEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || read != int64(len(noise+accepted)) {
+		t.Errorf("scanAuthLog() = %d logins after %d bytes, want 1 after %d", len(events), read, len(noise+accepted))
+	}
+
+	// Logins past the limit are left for the next run
+	log = accepted + noise + accepted
+	events, read, err = scanAuthLog(strings.NewReader(log), loginFixtureTime, time.UTC, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || read != int64(len(accepted)) {
+		t.Errorf("scanAuthLog() = %d logins after %d bytes, want 1 after %d", len(events), read, len(accepted))
+	}
+}
+
+// writeAuthLogins writes count accepted logins to an auth log, after the
+// contents it already has, numbering their source ports from port.
+func writeAuthLogins(t *testing.T, path string, port, count int) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < count; i++ {
+		line := fmt.Sprintf("Jun  3 08:20:49 app1 sshd[%d]: Accepted publickey for ubuntu from 192.0.2.14 port %d ssh2\n", 1000+i, port+i)
+		if _, err := f.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestAuthLog reads the logins added to an auth log since the previous
+// call, and saves the position for the next.
+func readTestAuthLog(t *testing.T, path string) ([]metrics.LoginEvent, authLogPosition) {
+	t.Helper()
+	events, pos, err := readAuthLog(path, loginFixtureTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeState(authLogStateFile, pos); err != nil {
+		t.Fatal(err)
+	}
+	return events, pos
+}
+
+func TestReadAuthLogRotatedPastLimit(t *testing.T) {
+	useTestStateDir(t)
+	path := filepath.Join(t.TempDir(), "auth.log")
+	writeAuthLogins(t, path, 30000, 2)
+	if events, _ := readTestAuthLog(t, path); len(events) != 0 {
+		t.Fatalf("first read gave %d logins, want none", len(events))
+	}
+
+	// More logins are left in the rotated log than can be sent at once
+	writeAuthLogins(t, path, 40000, maxLoginEvents+500)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeAuthLogins(t, path, 50000, 10)
+
+	events, pos := readTestAuthLog(t, path)
+	if len(events) != maxLoginEvents || events[0].SourcePort != 40000 {
+		t.Fatalf("first read after rotating gave %d logins, want %d from port 40000", len(events), maxLoginEvents)
+	}
+	info, err := os.Stat(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos.Inode != fileInode(info) {
+		t.Errorf("position moved to the new log before the rotated log was read")
+	}
+
+	events, _ = readTestAuthLog(t, path)
+	if len(events) != 510 || events[0].SourcePort != 40000+maxLoginEvents || events[500].SourcePort != 50000 {
+		t.Fatalf("second read after rotating gave %d logins, want the last 500 of the rotated log and 10 new ones", len(events))
+	}
+
+	if events, _ = readTestAuthLog(t, path); len(events) != 0 {
+		t.Errorf("third read after rotating gave %d logins, want none", len(events))
+	}
+}
+
+func TestReadAuthLogTruncatedAndRegrown(t *testing.T) {
+	useTestStateDir(t)
+	path := filepath.Join(t.TempDir(), "auth.log")
+	writeAuthLogins(t, path, 30000, 3)
+	readTestAuthLog(t, path)
+	writeAuthLogins(t, path, 40000, 2)
+	if events, _ := readTestAuthLog(t, path); len(events) != 2 {
+		t.Fatalf("read before truncating gave %d logins, want 2", len(events))
+	}
+
+	// The log is copied and truncated, then grows past the old offset
+	// before the next run
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	writeAuthLogins(t, path, 50000, 8)
+
+	events, _ := readTestAuthLog(t, path)
+	if len(events) != 8 || events[0].SourcePort != 50000 {
+		t.Errorf("read after truncating gave %d logins, want all 8 from the start", len(events))
+	}
+}
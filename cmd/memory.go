@@ -0,0 +1,158 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// pressureDir holds the Linux pressure stall information, on kernels built
+// with PSI support
+var pressureDir = "/proc/pressure"
+
+// pressureResources are the resources the kernel reports pressure for
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// memoryCollector reports memory, swap and huge page use, and the pressure
+// on the cpu, memory and io resources
+type memoryCollector struct{}
+
+func (memoryCollector) Name() string { return "memory" }
+
+func (memoryCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	var err error
+	p.Memory, err = collectMemoryMetrics(ctx)
+	return err
+}
+
+// collectMemoryMetrics reports memory, swap and huge page use, and the
+// pressure stall information when the kernel provides it.
+func collectMemoryMetrics(ctx context.Context) (*metrics.Memory, error) {
+	result := &metrics.Memory{Pressure: map[string]metrics.Pressure{}}
+
+	memory, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	result.TotalBytes = memory.Total
+	result.AvailableBytes = memory.Available
+	result.UsedBytes = memory.Used
+	result.FreeBytes = memory.Free
+	result.UsedPercent = memory.UsedPercent
+	result.BuffersBytes = memory.Buffers
+	result.CachedBytes = memory.Cached
+	result.HugePages = metrics.HugePages{
+		Total:     memory.HugePagesTotal,
+		Free:      memory.HugePagesFree,
+		SizeBytes: memory.HugePageSize,
+	}
+
+	swap, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	result.Swap = metrics.Swap{
+		TotalBytes:  swap.Total,
+		UsedBytes:   swap.Used,
+		FreeBytes:   swap.Free,
+		UsedPercent: swap.UsedPercent,
+	}
+
+	for _, resource := range pressureResources {
+		f, err := os.Open(filepath.Join(pressureDir, resource))
+		if err != nil {
+			// PSI is missing on older kernels, and disabled on some distributions
+			if os.IsNotExist(err) {
+				continue
+			}
+			return result, err
+		}
+
+		pressure, err := parsePressure(f)
+		f.Close()
+		if err != nil {
+			return result, fmt.Errorf("unable to read the %s pressure: %v", resource, err)
+		}
+		result.Pressure[resource] = pressure
+	}
+
+	return result, nil
+}
+
+// parsePressure reads a /proc/pressure file, which looks like:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePressure(r io.Reader) (metrics.Pressure, error) {
+	var pressure metrics.Pressure
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var averages metrics.PressureAverages
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return pressure, err
+			}
+
+			switch parts[0] {
+			case "avg10":
+				averages.Avg10Percent = value
+			case "avg60":
+				averages.Avg60Percent = value
+			case "avg300":
+				averages.Avg300Percent = value
+			}
+		}
+
+		switch fields[0] {
+		case "some":
+			pressure.Some = averages
+		case "full":
+			pressure.Full = &averages
+		}
+	}
+
+	return pressure, scanner.Err()
+}
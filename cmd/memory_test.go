@@ -0,0 +1,139 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+)
+
+func TestParsePressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    metrics.Pressure
+		wantErr bool
+	}{
+		{
+			name:  "some and full",
+			input: "some avg10=0.12 avg60=0.25 avg300=0.08 total=8331275\nfull avg10=0.05 avg60=0.11 avg300=0.03 total=4128863\n",
+			want: metrics.Pressure{
+				Some: metrics.PressureAverages{Avg10Percent: 0.12, Avg60Percent: 0.25, Avg300Percent: 0.08},
+				Full: &metrics.PressureAverages{Avg10Percent: 0.05, Avg60Percent: 0.11, Avg300Percent: 0.03},
+			},
+		},
+		{
+			// The cpu file has no full line before Linux 5.13
+			name:  "some only",
+			input: "some avg10=1.52 avg60=0.87 avg300=0.31 total=48213337\n",
+			want:  metrics.Pressure{Some: metrics.PressureAverages{Avg10Percent: 1.52, Avg60Percent: 0.87, Avg300Percent: 0.31}},
+		},
+		{
+			name:  "blank lines",
+			input: "\nsome avg10=1.00 avg60=2.00 avg300=3.00 total=1\n\n",
+			want:  metrics.Pressure{Some: metrics.PressureAverages{Avg10Percent: 1, Avg60Percent: 2, Avg300Percent: 3}},
+		},
+		{
+			name:  "unknown fields and lines",
+			input: "some avg10=1.00 avg30=9.00 avg60=2.00 avg300=3.00 stalled total=1\npartial avg10=5.00\n",
+			want:  metrics.Pressure{Some: metrics.PressureAverages{Avg10Percent: 1, Avg60Percent: 2, Avg300Percent: 3}},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  metrics.Pressure{},
+		},
+		{
+			name:    "invalid number",
+			input:   "some avg10=high avg60=0.00 avg300=0.00 total=0\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid total",
+			input:   "some avg10=0.00 avg60=0.00 avg300=0.00 total=\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePressure(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePressure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePressure() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The huge pages are read by gopsutil from /proc/meminfo, which it finds
+// with HOST_PROC, and are only reported on Linux.
+func TestCollectMemoryMetricsHugePages(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("huge pages are only read from /proc/meminfo on Linux")
+	}
+
+	t.Setenv("HOST_PROC", filepath.Join("testdata", "memory"))
+	previous := pressureDir
+	pressureDir = filepath.Join("testdata", "memory", "pressure")
+	defer func() { pressureDir = previous }()
+
+	got, err := collectMemoryMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := metrics.HugePages{Total: 512, Free: 384, SizeBytes: 2 * 1024 * 1024}
+	if got.HugePages != want {
+		t.Errorf("HugePages = %+v, want %+v", got.HugePages, want)
+	}
+	if got.TotalBytes != 8029412*1024 || got.AvailableBytes != 5125648*1024 {
+		t.Errorf("TotalBytes, AvailableBytes = %d, %d, want %d, %d", got.TotalBytes, got.AvailableBytes, 8029412*1024, 5125648*1024)
+	}
+
+	io := metrics.PressureAverages{Avg10Percent: 3.40, Avg60Percent: 2.18, Avg300Percent: 1.09}
+	if len(got.Pressure) != 3 || got.Pressure["io"].Some != io {
+		t.Errorf("Pressure = %+v, want cpu, memory and io with io some %+v", got.Pressure, io)
+	}
+}
+
+func TestCollectMemoryMetricsWithoutPressure(t *testing.T) {
+	previous := pressureDir
+	pressureDir = filepath.Join(t.TempDir(), "pressure")
+	defer func() { pressureDir = previous }()
+
+	got, err := collectMemoryMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Pressure) != 0 {
+		t.Errorf("Pressure = %+v, want none", got.Pressure)
+	}
+}
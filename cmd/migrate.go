@@ -0,0 +1,352 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the config layout written by this agent
+const currentConfigVersion = 1
+
+var migrateDryRun bool
+
+// configMigration upgrades the config layout from version From to From+1.
+// Migrations work on the YAML document itself, so comments and the order of
+// settings are kept.
+type configMigration struct {
+	From        int
+	Description string
+	Apply       func(root *yaml.Node) error
+}
+
+// configMigrations must be kept in order, one for every past version
+var configMigrations = []configMigration{
+	{
+		From:        0,
+		Description: "add the version setting and use consistent names for account settings",
+		Apply:       migrateUnversionedConfig,
+	},
+}
+
+// migrateUnversionedConfig upgrades the original layout, which had no
+// version. Account settings may have been written in any case, e.g. `apikey`
+// when the config was last saved by viper, so they are renamed to the names
+// the agent writes today.
+func migrateUnversionedConfig(root *yaml.Node) error {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		if _, known := configSchema.Fields[strings.ToLower(key.Value)]; known {
+			key.Value = strings.ToLower(key.Value)
+		}
+	}
+
+	accounts := mappingValue(root, "accounts")
+	if accounts == nil || accounts.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	canonical := map[string]string{}
+	for _, name := range []string{"username", "apiKey", "createUser", "shell", "home", "group", "groups", "userCreated"} {
+		canonical[strings.ToLower(name)] = name
+	}
+
+	for _, account := range accounts.Content {
+		if account.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(account.Content); i += 2 {
+			key := account.Content[i]
+			if name, ok := canonical[strings.ToLower(key.Value)]; ok {
+				key.Value = name
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateConfigData upgrades a config document to the current version,
+// returning the new document and the migrations that were applied. A config
+// that is already current is returned unchanged.
+func migrateConfigData(data []byte) ([]byte, []configMigration, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	// There is nothing to migrate in an empty file
+	if len(doc.Content) == 0 {
+		return data, nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("the config must be a set of settings")
+	}
+
+	version := 0
+	if node := mappingValue(root, "version"); node != nil {
+		var err error
+		if version, err = strconv.Atoi(node.Value); err != nil {
+			return nil, nil, fmt.Errorf("the config version %q is not a number", node.Value)
+		}
+	}
+
+	if version > currentConfigVersion {
+		return nil, nil, fmt.Errorf("the config is version %d, which is newer than this agent supports (%d). Please update the agent", version, currentConfigVersion)
+	}
+
+	var applied []configMigration
+	for _, migration := range configMigrations {
+		if migration.From < version {
+			continue
+		}
+		if migration.From != version {
+			return nil, nil, fmt.Errorf("there is no migration from config version %d", version)
+		}
+
+		if err := migration.Apply(root); err != nil {
+			return nil, nil, fmt.Errorf("migrating from version %d failed: %v", version, err)
+		}
+
+		version++
+		setConfigVersion(root, version)
+		applied = append(applied, migration)
+	}
+
+	if len(applied) == 0 {
+		return data, nil, nil
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	encoder.Close()
+
+	return out.Bytes(), applied, nil
+}
+
+// upgradeConfigFile migrates the main config file in place under the config
+// lock, saving a copy of the original first. It returns the migrations that
+// were applied and where the copy was saved.
+func upgradeConfigFile() ([]configMigration, string, error) {
+	var applied []configMigration
+	var backup string
+
+	err := lockConfig(func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		migrated, migrations, err := migrateConfigData(data)
+		if err != nil || len(migrations) == 0 {
+			return err
+		}
+
+		backup = fmt.Sprintf("%s.v%d-%s.bak", path, migrations[0].From, time.Now().UTC().Format("20060102-150405"))
+		if err := writeFileAtomic(backup, data, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("unable to save a copy of the config: %v", err)
+		}
+
+		if err := writeFileAtomic(path, migrated, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		applied = migrations
+		return nil
+	})
+
+	return applied, backup, err
+}
+
+// mappingValue returns the value for key in a YAML mapping, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setConfigVersion sets the version setting, adding it as the first setting
+// if it isn't already present.
+func setConfigVersion(root *yaml.Node, version int) {
+	if node := mappingValue(root, "version"); node != nil {
+		node.Kind = yaml.ScalarNode
+		node.Tag = "!!int"
+		node.Value = strconv.Itoa(version)
+		return
+	}
+
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)}
+
+	// Keep any comment at the top of the file above the new setting
+	if len(root.Content) > 0 {
+		key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+	}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+}
+
+// maskedSecret is shown in place of secrets
+const maskedSecret = "********"
+
+// maskConfigSecrets hides the secrets in a config document so it can be
+// shown: the apikey and teamkey settings, and every file:, env: or
+// credential: reference, of which only the kind is kept.
+func maskConfigSecrets(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+
+	maskSecretNodes(&doc, false)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	return out.Bytes(), nil
+}
+
+// maskSecretNodes masks the secrets in a YAML node and everything beneath
+// it. secret is set for the value of a secret setting.
+func maskSecretNodes(node *yaml.Node, secret bool) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return
+		}
+		if isSecretReference(node.Value) {
+			node.Value = node.Value[:strings.Index(node.Value, ":")+1] + maskedSecret
+		} else if secret {
+			node.Value = maskedSecret
+		} else {
+			return
+		}
+		node.Tag, node.Style = "!!str", 0
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := strings.ToLower(node.Content[i].Value)
+			maskSecretNodes(node.Content[i+1], name == "apikey" || name == "teamkey")
+		}
+
+	default:
+		for _, child := range node.Content {
+			maskSecretNodes(child, false)
+		}
+	}
+}
+
+// configMigrateCmd represents the config migrate command
+var configMigrateCmd = &cobra.Command{
+	Use:         "migrate",
+	Short:       "Upgrade the configuration to the current version",
+	Long:        `Upgrade a config file written by an older version of the agent to the current layout. A copy of the original is saved next to it. Use --dry-run to see the changes without making them.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		readConfig()
+		path := configFile()
+
+		if !migrateDryRun {
+			applied, backup, err := upgradeConfigFile()
+			if err != nil {
+				color.Red("Unable to migrate %s: %s", path, err)
+				os.Exit(1)
+			}
+			if len(applied) == 0 {
+				color.Green("The config in %s is already at version %d - no changes needed.", path, currentConfigVersion)
+				return
+			}
+
+			for _, migration := range applied {
+				fmt.Printf("  version %d to %d: %s\n", migration.From, migration.From+1, migration.Description)
+			}
+			color.Green("The config in %s has been migrated to version %d. A copy of the old config was saved to %s", path, currentConfigVersion, backup)
+			return
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			color.Red("Unable to read %s: %s", path, err)
+			os.Exit(1)
+		}
+
+		migrated, applied, err := migrateConfigData(data)
+		if err != nil {
+			color.Red("Unable to migrate %s: %s", path, err)
+			os.Exit(1)
+		}
+		if len(applied) == 0 {
+			color.Green("The config in %s is already at version %d - no changes needed.", path, currentConfigVersion)
+			return
+		}
+
+		color.Yellow("The following migrations would be applied to %s:", path)
+		for _, migration := range applied {
+			fmt.Printf("  version %d to %d: %s\n", migration.From, migration.From+1, migration.Description)
+		}
+		masked, err := maskConfigSecrets(migrated)
+		if err != nil {
+			color.Red("Unable to migrate %s: %s", path, err)
+			os.Exit(1)
+		}
+
+		color.Yellow("\nThe migrated config would be, with secrets hidden:")
+		fmt.Print(string(masked))
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configMigrateCmd)
+
+	configMigrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Show the changes without making them")
+}
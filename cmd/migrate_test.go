@@ -0,0 +1,155 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every past config layout has a fixture in testdata/migrations, as a
+// <name>.input.yaml file and the <name>.expected.yaml it must migrate to.
+func TestMigrateConfigData(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "migrations", "*.input.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no migration fixtures found")
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".input.yaml")
+
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := ioutil.ReadFile(strings.TrimSuffix(input, ".input.yaml") + ".expected.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			migrated, _, err := migrateConfigData(data)
+			if err != nil {
+				t.Fatalf("migrateConfigData() error = %v", err)
+			}
+			if string(migrated) != string(expected) {
+				t.Errorf("migrateConfigData() =\n%s\nwant\n%s", migrated, expected)
+			}
+
+			// Migrating an up to date config must not change it
+			again, applied, err := migrateConfigData(migrated)
+			if err != nil {
+				t.Fatalf("migrateConfigData() on migrated config error = %v", err)
+			}
+			if len(applied) != 0 || string(again) != string(migrated) {
+				t.Errorf("migrateConfigData() changed an up to date config, applied %d migrations", len(applied))
+			}
+		})
+	}
+}
+
+func TestMigrateConfigDataAppliesEveryMigration(t *testing.T) {
+	_, applied, err := migrateConfigData([]byte("orgid: org-123\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != currentConfigVersion {
+		t.Errorf("applied %d migrations to an unversioned config, want %d", len(applied), currentConfigVersion)
+	}
+	for i, migration := range applied {
+		if migration.From != i {
+			t.Errorf("migration %d upgrades from version %d, want %d", i, migration.From, i)
+		}
+	}
+}
+
+func TestMigrateConfigDataErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"newer version", "version: 99\norgid: org-123\n"},
+		{"version not a number", "version: one\n"},
+		{"not a mapping", "- orgid\n"},
+		{"invalid yaml", "orgid: [\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := migrateConfigData([]byte(tt.data)); err == nil {
+				t.Errorf("migrateConfigData(%q) expected an error", tt.data)
+			}
+		})
+	}
+}
+
+func TestMaskConfigSecrets(t *testing.T) {
+	data := `version: 1
+orgid: org-123
+apikey: server-key
+teamkey: env:SERVERAUTH_TEAMKEY
+accounts:
+    - username: deploy
+      apikey: file:/etc/serverauth/deploy.key
+    - username: backup
+      apiKey: "backup-key"
+profiles:
+    staging:
+        apikey: credential:staging
+        teamkey:
+monitor:
+    checks:
+        - name: token
+          command: /usr/local/bin/check --password env:CHECK_PASSWORD
+`
+	want := `version: 1
+orgid: org-123
+apikey: '********'
+teamkey: env:********
+accounts:
+    - username: deploy
+      apikey: file:********
+    - username: backup
+      apiKey: '********'
+profiles:
+    staging:
+        apikey: credential:********
+        teamkey:
+monitor:
+    checks:
+        - name: token
+          command: /usr/local/bin/check --password env:CHECK_PASSWORD
+`
+
+	masked, err := maskConfigSecrets([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(masked) != want {
+		t.Errorf("maskConfigSecrets() =\n%s\nwant\n%s", masked, want)
+	}
+}
@@ -22,156 +22,147 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"runtime"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/fatih/color"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/disk"
-	"github.com/shirou/gopsutil/host"
-	"github.com/shirou/gopsutil/load"
-
-	"github.com/shirou/gopsutil/mem"
+	"github.com/serverauth-com/serverauth-agent/metrics"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// The monitor.format setting chooses how metrics are sent. The form encoding
+// stays the default until every account can receive the JSON payload, which
+// has to be chosen with monitor.format: json until then.
+const (
+	monitorFormatJSON = "json"
+	monitorFormatForm = "form"
+)
+
+var monitorProfile string
+
 var actionCmd = &cobra.Command{
 	Use:   "monitor",
 	Short: "Collect server metrics",
 	Long:  `Collects the latest server monitoring metrics and sends them to your ServerAuth account.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Read in the existing accounts and get ready for adding another user
-		viper.ReadInConfig()
-
-		var accounts []Account
-		configErr := viper.UnmarshalKey("accounts", &accounts)
+		readConfig()
 
-		if configErr != nil {
-			color.Red("There was a problem setting up the user account.\nPlease try again or contact ServerAuth for assistance.")
+		profiles, profileErr := selectProfiles(monitorProfile)
+		if profileErr != nil {
+			color.Red("%s", profileErr.Error())
 			os.Exit(1)
 		}
 
-		// Get the organisation id
-		var orgId string
-		viper.UnmarshalKey("orgid", &orgId)
-
-		if len(orgId) <= 0 {
-			color.Red("The organisation id is missing from your ServerAuth configuration.\nPlease check you've correctly configured ServerAuth on this server and try again.")
-			os.Exit(1)
+		// Every profile needs its credentials before anything is sent
+		var servers []serverConfig
+		for _, profile := range profiles {
+			server, serverErr := loadServerConfig(profile, true)
+			if serverErr != nil {
+				color.Red("%s", serverErr.Error())
+				os.Exit(1)
+			}
+			servers = append(servers, server)
 		}
 
-		// Get the server api key
-		var serverAPIKey string
-		viper.UnmarshalKey("apikey", &serverAPIKey)
+		payload, state := collectMonitoringPayload()
 
-		if len(serverAPIKey) <= 0 {
-			color.Red("The server API key is missing.\nPlease check you've correctly configured ServerAuth on this server and try again.")
+		body, contentType, err := encodeMonitoringPayload(payload, viper.GetString("monitor.format"))
+		if err != nil {
+			color.Red("Unable to encode the metrics: %s", err)
 			os.Exit(1)
 		}
 
-		// Get the team api key
-		var teamAPIKey string
-		viper.UnmarshalKey("teamkey", &teamAPIKey)
+		// Send the metrics to the organisation of every profile
+		failed := false
+		for _, server := range servers {
+			if err := sendMonitoringPayload(server, body, contentType); err != nil {
+				color.Red("Unable to send the metrics for profile %s: %s", server.Profile, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
 
-		if len(teamAPIKey) <= 0 {
-			color.Red("The team API key is missing.\nPlease check you've correctly configured ServerAuth on this server and try again.")
+		// Positions such as the auth log offset are only moved on once the
+		// metrics have been sent, so nothing is lost when sending fails
+		if err := state.save(); err != nil {
+			color.Red("Unable to save the monitoring state: %s", err)
 			os.Exit(1)
 		}
+	},
+}
 
-		// Get the base domain, which can optionally be overridden
-		var baseDomain string
-		viper.UnmarshalKey("basedomain", &baseDomain)
+// collectMonitoringPayload runs every enabled collector, returning the
+// payload and the state to save once it has been sent. A group of metrics
+// that can't be collected is reported and left out, so the rest are still
+// sent.
+func collectMonitoringPayload() (*metrics.Payload, collectorState) {
+	payload := metrics.New(time.Now())
+	payload.Agent = metrics.Agent{Name: "serverauth-agent", Version: agentVersion}
 
-		if len(baseDomain) <= 0 {
-			// No overridden base domain, fall back to the default
-			baseDomain = "https://api.serverauth.com/"
-		}
+	var err error
+	if payload.Host, err = hostIdentity(); err != nil {
+		color.Red("Unable to identify the server: %s", err)
+	}
 
-		// Build the base url
-		baseURL := baseDomain + "monitoring"
-
-		// Get current system stats
-		memory, _ := mem.VirtualMemory()
-		loadAvg, _ := load.Avg()
-		cpuHw, _ := cpu.Info()
-		//percent, _ := cpu.Percent(time.Second, true)
-		uptime, _ := host.Uptime()
-		misc, _ := load.Misc()
-		platform, family, version, _ := host.PlatformInformation()
-		diskStat, err := disk.Usage("/")
-		currentTime := time.Now()
-		timeZone, timeOffset := currentTime.Zone()
-
-		// Create http client
-		httpClient := http.Client{
-			Timeout: time.Second * 10, // Maximum of 10 secs
-		}
+	state := runCollectors(payload)
 
-		form := url.Values{}
-
-		// Mem
-		form.Add("mem[total]", fmt.Sprint(memory.Total))
-		form.Add("mem[free]", fmt.Sprint(memory.Free))
-		form.Add("mem[used]", fmt.Sprint(memory.Used))
-		form.Add("mem[used_percent]", fmt.Sprint(memory.UsedPercent))
-
-		// Loadavg
-		form.Add("load[1]", fmt.Sprint(loadAvg.Load1))
-		form.Add("load[5]", fmt.Sprint(loadAvg.Load5))
-		form.Add("load[15]", fmt.Sprint(loadAvg.Load15))
-
-		// Processes
-		form.Add("procs[running]", fmt.Sprint(misc.ProcsRunning))
-		form.Add("procs[blocked]", fmt.Sprint(misc.ProcsBlocked))
-		form.Add("procs[total]", fmt.Sprint(misc.ProcsTotal))
-
-		// Generic CPU HW
-		form.Add("cpu", fmt.Sprint(cpuHw))
-
-		// Uptime
-		form.Add("uptime_seconds", fmt.Sprint(uptime))
-
-		// Platform info
-		form.Add("platform[name]", fmt.Sprint(platform))
-		form.Add("platform[family]", fmt.Sprint(family))
-		form.Add("platform[version]", fmt.Sprint(version))
-
-		// Disk info
-		form.Add("disk[total]", strconv.FormatUint(diskStat.Total, 10))
-		form.Add("disk[used]", strconv.FormatUint(diskStat.Used, 10))
-		form.Add("disk[free]", strconv.FormatUint(diskStat.Free, 10))
-		form.Add("disk[percent_free]", strconv.FormatFloat(diskStat.UsedPercent, 'f', 2, 64))
-		form.Add("disk[inodes_total]", strconv.FormatUint(diskStat.InodesTotal, 10))
-		form.Add("disk[inodes_used]", strconv.FormatUint(diskStat.InodesUsed, 10))
-		form.Add("disk[inodes_free]", strconv.FormatUint(diskStat.InodesFree, 10))
-
-		// Time info
-		form.Add("time[zone]", fmt.Sprint(timeZone))
-		form.Add("time[offset]", fmt.Sprint(timeOffset))
-		form.Add("time[now]", fmt.Sprint(currentTime.Unix()))
-
-		// Create a request
-		req, err := http.NewRequest(http.MethodPost, baseURL, strings.NewReader(form.Encode()))
-		if err != nil {
-			log.Fatal(err)
+	for _, c := range collectors {
+		if err, failed := payload.Errors[c.Name()]; failed {
+			color.Red("Unable to collect the %s metrics: %s", c.Name(), err)
 		}
+	}
 
-		req.Header.Set("User-Agent", "ServerAuthAgent-v2.0.0;"+runtime.GOOS)
-		req.Header.Set("TeamApiKey", teamAPIKey)
-		req.Header.Set("ServerApiKey", serverAPIKey)
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-		httpClient.Do(req)
-	},
+	return payload, state
+}
+
+// encodeMonitoringPayload encodes the payload in the given format, returning
+// the body and its content type.
+func encodeMonitoringPayload(payload *metrics.Payload, format string) ([]byte, string, error) {
+	switch format {
+	case monitorFormatJSON:
+		body, err := json.Marshal(payload)
+		return body, metrics.ContentType, err
+	case "", monitorFormatForm:
+		return []byte(encodeMonitoringForm(payload).Encode()), "application/x-www-form-urlencoded", nil
+	}
+	return nil, "", fmt.Errorf("unknown monitor format %q", format)
+}
+
+// sendMonitoringPayload posts the encoded metrics to the organisation of a
+// profile.
+func sendMonitoringPayload(server serverConfig, body []byte, contentType string) error {
+	url := server.BaseDomain + "monitoring"
+	req, err := newAPIRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("TeamApiKey", server.TeamAPIKey)
+	req.Header.Set("ServerApiKey", server.ServerAPIKey)
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &APIError{URL: url, StatusCode: res.StatusCode}
+	}
+	return nil
 }
 
 func init() {
 	rootCmd.AddCommand(actionCmd)
+
+	actionCmd.Flags().StringVar(&monitorProfile, "profile", "", "Only send metrics to the organisation of this profile")
 }
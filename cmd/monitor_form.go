@@ -0,0 +1,268 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+)
+
+// formatFloat formats a measurement for the monitoring form. Every
+// measurement is sent with two decimal places, and counts as integers.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+// encodeMonitoringForm encodes a payload as the form fields sent by older
+// agents, for accounts that haven't moved to the JSON payload yet.
+func encodeMonitoringForm(p *metrics.Payload) url.Values {
+	form := url.Values{}
+
+	if m := p.Memory; m != nil {
+		form.Add("mem[total]", strconv.FormatUint(m.TotalBytes, 10))
+		form.Add("mem[free]", strconv.FormatUint(m.FreeBytes, 10))
+		form.Add("mem[used]", strconv.FormatUint(m.UsedBytes, 10))
+		form.Add("mem[used_percent]", formatFloat(m.UsedPercent))
+		form.Add("mem[available]", strconv.FormatUint(m.AvailableBytes, 10))
+		form.Add("mem[buffers]", strconv.FormatUint(m.BuffersBytes, 10))
+		form.Add("mem[cached]", strconv.FormatUint(m.CachedBytes, 10))
+
+		form.Add("swap[total]", strconv.FormatUint(m.Swap.TotalBytes, 10))
+		form.Add("swap[used]", strconv.FormatUint(m.Swap.UsedBytes, 10))
+		form.Add("swap[free]", strconv.FormatUint(m.Swap.FreeBytes, 10))
+		form.Add("swap[used_percent]", formatFloat(m.Swap.UsedPercent))
+
+		form.Add("hugepages[total]", strconv.FormatUint(m.HugePages.Total, 10))
+		form.Add("hugepages[free]", strconv.FormatUint(m.HugePages.Free, 10))
+		form.Add("hugepages[size]", strconv.FormatUint(m.HugePages.SizeBytes, 10))
+
+		for resource, pressure := range m.Pressure {
+			addPressureToForm(form, "pressure["+resource+"][some]", pressure.Some)
+			if pressure.Full != nil {
+				addPressureToForm(form, "pressure["+resource+"][full]", *pressure.Full)
+			}
+		}
+	}
+
+	if l := p.Load; l != nil {
+		form.Add("load[1]", formatFloat(l.Load1))
+		form.Add("load[5]", formatFloat(l.Load5))
+		form.Add("load[15]", formatFloat(l.Load15))
+	}
+
+	if procs := p.Processes; procs != nil {
+		form.Add("procs[running]", strconv.Itoa(procs.Running))
+		form.Add("procs[blocked]", strconv.Itoa(procs.Blocked))
+		form.Add("procs[total]", strconv.Itoa(procs.Total))
+	}
+
+	if top := p.TopProcesses; top != nil {
+		addProcessesToForm(form, "procs[top_cpu]", top.ByCPU)
+		addProcessesToForm(form, "procs[top_memory]", top.ByMemory)
+	}
+
+	if c := p.CPU; c != nil {
+		form.Add("cpu[model]", c.Model)
+		form.Add("cpu[cores]", strconv.Itoa(c.Cores))
+		form.Add("cpu[threads]", strconv.Itoa(c.Threads))
+
+		// Utilisation is left out until there are two samples to compare
+		if c.Usage != nil {
+			addCPUUsageToForm(form, "cpu", *c.Usage)
+			for i, core := range c.PerCore {
+				addCPUUsageToForm(form, fmt.Sprintf("cpu[core][%d]", i), core)
+			}
+		}
+	}
+
+	if sys := p.System; sys != nil {
+		form.Add("uptime_seconds", strconv.FormatUint(sys.UptimeSeconds, 10))
+		form.Add("platform[name]", sys.Platform)
+		form.Add("platform[family]", sys.PlatformFamily)
+		form.Add("platform[version]", sys.PlatformVersion)
+	}
+
+	for i, fs := range p.Filesystems {
+		key := fmt.Sprintf("filesystems[%d]", i)
+		form.Add(key+"[mountpoint]", fs.Mountpoint)
+		form.Add(key+"[device]", fs.Device)
+		form.Add(key+"[fstype]", fs.FSType)
+		if fs.Error != "" {
+			form.Add(key+"[error]", fs.Error)
+			continue
+		}
+
+		// Older agents only reported the root filesystem, under disk
+		if fs.Mountpoint == "/" {
+			form.Add("disk[total]", strconv.FormatUint(fs.TotalBytes, 10))
+			form.Add("disk[used]", strconv.FormatUint(fs.UsedBytes, 10))
+			form.Add("disk[free]", strconv.FormatUint(fs.FreeBytes, 10))
+			form.Add("disk[used_percent]", formatFloat(fs.UsedPercent))
+			// Despite its name, percent_free has always held the used
+			// percentage, and existing dashboards rely on that
+			form.Add("disk[percent_free]", formatFloat(fs.UsedPercent))
+			form.Add("disk[inodes_total]", strconv.FormatUint(fs.InodesTotal, 10))
+			form.Add("disk[inodes_used]", strconv.FormatUint(fs.InodesUsed, 10))
+			form.Add("disk[inodes_free]", strconv.FormatUint(fs.InodesFree, 10))
+		}
+
+		form.Add(key+"[total]", strconv.FormatUint(fs.TotalBytes, 10))
+		form.Add(key+"[used]", strconv.FormatUint(fs.UsedBytes, 10))
+		form.Add(key+"[free]", strconv.FormatUint(fs.FreeBytes, 10))
+		form.Add(key+"[used_percent]", formatFloat(fs.UsedPercent))
+		form.Add(key+"[inodes_total]", strconv.FormatUint(fs.InodesTotal, 10))
+		form.Add(key+"[inodes_used]", strconv.FormatUint(fs.InodesUsed, 10))
+		form.Add(key+"[inodes_free]", strconv.FormatUint(fs.InodesFree, 10))
+	}
+
+	for _, device := range p.DiskIO {
+		key := "diskio[" + device.Device + "]"
+		form.Add(key+"[read_iops]", formatFloat(device.ReadOpsPerSecond))
+		form.Add(key+"[write_iops]", formatFloat(device.WriteOpsPerSecond))
+		form.Add(key+"[read_bytes_per_sec]", formatFloat(device.ReadBytesPerSecond))
+		form.Add(key+"[write_bytes_per_sec]", formatFloat(device.WriteBytesPerSecond))
+		form.Add(key+"[read_latency_ms]", formatFloat(device.ReadLatencyMilliseconds))
+		form.Add(key+"[write_latency_ms]", formatFloat(device.WriteLatencyMilliseconds))
+		form.Add(key+"[util_percent]", formatFloat(device.UtilisationPercent))
+	}
+
+	if n := p.Network; n != nil {
+		for _, iface := range n.Interfaces {
+			key := "net[interfaces][" + iface.Name + "]"
+			for _, addr := range iface.Addresses {
+				form.Add(key+"[addresses][]", addr)
+			}
+
+			if t := iface.Traffic; t != nil {
+				form.Add(key+"[bytes_in_per_sec]", formatFloat(t.BytesInPerSecond))
+				form.Add(key+"[bytes_out_per_sec]", formatFloat(t.BytesOutPerSecond))
+				form.Add(key+"[packets_in_per_sec]", formatFloat(t.PacketsInPerSecond))
+				form.Add(key+"[packets_out_per_sec]", formatFloat(t.PacketsOutPerSecond))
+				form.Add(key+"[errors_in_per_sec]", formatFloat(t.ErrorsInPerSecond))
+				form.Add(key+"[errors_out_per_sec]", formatFloat(t.ErrorsOutPerSecond))
+				form.Add(key+"[drops_in_per_sec]", formatFloat(t.DropsInPerSecond))
+				form.Add(key+"[drops_out_per_sec]", formatFloat(t.DropsOutPerSecond))
+			}
+		}
+
+		for state, count := range n.TCPConnections {
+			form.Add("net[tcp]["+strings.ToLower(state)+"]", strconv.Itoa(count))
+		}
+		form.Add("net[ssh_sessions]", strconv.Itoa(n.SSHSessions))
+	}
+
+	for _, check := range p.Checks {
+		key := "checks[" + check.Name + "]"
+		form.Add(key+"[status]", check.Status)
+		form.Add(key+"[exit_code]", strconv.Itoa(check.ExitCode))
+		form.Add(key+"[output]", check.Output)
+		form.Add(key+"[duration_ms]", formatFloat(check.DurationMilliseconds))
+
+		// Perfdata is sent exactly as the plugin reported it, as rounding
+		// would change values like response times in seconds
+		for _, perf := range check.Perfdata {
+			perfKey := key + "[perfdata][" + perf.Label + "]"
+			if perf.Value != nil {
+				form.Add(perfKey+"[value]", strconv.FormatFloat(*perf.Value, 'f', -1, 64))
+			}
+			form.Add(perfKey+"[unit]", perf.Unit)
+			form.Add(perfKey+"[warning]", perf.Warning)
+			form.Add(perfKey+"[critical]", perf.Critical)
+			if perf.Min != nil {
+				form.Add(perfKey+"[min]", strconv.FormatFloat(*perf.Min, 'f', -1, 64))
+			}
+			if perf.Max != nil {
+				form.Add(perfKey+"[max]", strconv.FormatFloat(*perf.Max, 'f', -1, 64))
+			}
+		}
+	}
+
+	for _, service := range p.Services {
+		key := "services[" + service.Name + "]"
+		form.Add(key+"[load_state]", service.LoadState)
+		form.Add(key+"[active_state]", service.ActiveState)
+		form.Add(key+"[sub_state]", service.SubState)
+		form.Add(key+"[result]", service.Result)
+		form.Add(key+"[restarts]", strconv.FormatUint(uint64(service.Restarts), 10))
+		if service.StateChangedAt != nil {
+			form.Add(key+"[seconds_in_state]", strconv.FormatUint(service.SecondsInState, 10))
+		}
+	}
+
+	for i, login := range p.Logins {
+		key := fmt.Sprintf("logins[%d]", i)
+		form.Add(key+"[time]", strconv.FormatInt(login.Time.Unix(), 10))
+		form.Add(key+"[result]", login.Result)
+		form.Add(key+"[user]", login.User)
+		form.Add(key+"[invalid_user]", strconv.FormatBool(login.InvalidUser))
+		form.Add(key+"[source_ip]", login.SourceIP)
+		form.Add(key+"[source_port]", strconv.Itoa(login.SourcePort))
+		form.Add(key+"[method]", login.Method)
+		form.Add(key+"[key_type]", login.KeyType)
+		form.Add(key+"[key_fingerprint]", login.KeyFingerprint)
+		form.Add(key+"[pid]", strconv.Itoa(login.PID))
+	}
+
+	if t := p.Time; t != nil {
+		form.Add("time[zone]", t.Timezone)
+		form.Add("time[offset]", strconv.Itoa(t.UTCOffsetSeconds))
+	}
+	form.Add("time[now]", strconv.FormatInt(p.CollectedAt.Unix(), 10))
+
+	return form
+}
+
+// addCPUUsageToForm adds the usage percentages under the given form key.
+func addCPUUsageToForm(form url.Values, key string, u metrics.CPUUsage) {
+	form.Add(key+"[used_percent]", formatFloat(u.UsedPercent))
+	form.Add(key+"[user_percent]", formatFloat(u.UserPercent))
+	form.Add(key+"[system_percent]", formatFloat(u.SystemPercent))
+	form.Add(key+"[iowait_percent]", formatFloat(u.IOWaitPercent))
+	form.Add(key+"[steal_percent]", formatFloat(u.StealPercent))
+	form.Add(key+"[idle_percent]", formatFloat(u.IdlePercent))
+}
+
+// addProcessesToForm adds a list of processes under the given form key.
+func addProcessesToForm(form url.Values, key string, procs []metrics.Process) {
+	for i, proc := range procs {
+		procKey := fmt.Sprintf("%s[%d]", key, i)
+		form.Add(procKey+"[pid]", strconv.FormatInt(int64(proc.PID), 10))
+		form.Add(procKey+"[user]", proc.User)
+		form.Add(procKey+"[name]", proc.Name)
+		form.Add(procKey+"[command]", proc.Command)
+		form.Add(procKey+"[rss]", strconv.FormatUint(proc.RSSBytes, 10))
+		form.Add(procKey+"[mem_percent]", formatFloat(proc.MemoryPercent))
+		form.Add(procKey+"[cpu_percent]", formatFloat(proc.CPUPercent))
+		form.Add(procKey+"[started]", strconv.FormatInt(proc.StartedAt.Unix(), 10))
+	}
+}
+
+// addPressureToForm adds the pressure averages under the given form key.
+func addPressureToForm(form url.Values, key string, p metrics.PressureAverages) {
+	form.Add(key+"[avg10]", formatFloat(p.Avg10Percent))
+	form.Add(key+"[avg60]", formatFloat(p.Avg60Percent))
+	form.Add(key+"[avg300]", formatFloat(p.Avg300Percent))
+}
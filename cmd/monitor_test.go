@@ -0,0 +1,99 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+)
+
+func TestEncodeMonitoringPayload(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		contentType string
+		wantErr     bool
+	}{
+		// Accounts that haven't set a format still need the form encoding
+		{name: "unset", format: "", contentType: "application/x-www-form-urlencoded"},
+		{name: "form", format: "form", contentType: "application/x-www-form-urlencoded"},
+		{name: "json", format: "json", contentType: metrics.ContentType},
+		{name: "xml", format: "xml", wantErr: true},
+	}
+
+	payload := metrics.New(time.Unix(1700000000, 0))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType, err := encodeMonitoringPayload(payload, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encodeMonitoringPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if contentType != tt.contentType {
+				t.Errorf("encodeMonitoringPayload() content type = %q, want %q", contentType, tt.contentType)
+			}
+			if len(body) == 0 {
+				t.Error("encodeMonitoringPayload() body is empty")
+			}
+		})
+	}
+}
+
+func TestEncodeMonitoringFormNumbers(t *testing.T) {
+	payload := metrics.New(time.Unix(1700000000, 0))
+	payload.Memory = &metrics.Memory{TotalBytes: 8221057024, UsedPercent: 36.187654}
+	payload.Load = &metrics.Load{Load1: 0.5, Load5: 1.234567, Load15: 2}
+	payload.Filesystems = []metrics.Filesystem{
+		{Mountpoint: "/", Device: "/dev/sda1", FSType: "ext4", TotalBytes: 1000, UsedPercent: 42.5},
+		{Mountpoint: "/mnt/nas", Device: "nas:/share", FSType: "nfs4", Error: "stale file handle"},
+	}
+
+	form := encodeMonitoringForm(payload)
+	want := url.Values{
+		"mem[total]":                 {"8221057024"},
+		"mem[used_percent]":          {"36.19"},
+		"load[1]":                    {"0.50"},
+		"load[5]":                    {"1.23"},
+		"load[15]":                   {"2.00"},
+		"disk[used_percent]":         {"42.50"},
+		"disk[percent_free]":         {"42.50"},
+		"filesystems[0][total]":      {"1000"},
+		"filesystems[1][mountpoint]": {"/mnt/nas"},
+		"filesystems[1][error]":      {"stale file handle"},
+		"time[now]":                  {"1700000000"},
+	}
+	for key, values := range want {
+		if got := form[key]; len(got) != 1 || got[0] != values[0] {
+			t.Errorf("form[%q] = %q, want %q", key, got, values[0])
+		}
+	}
+
+	// An unreadable filesystem has no usage to send
+	if _, ok := form["filesystems[1][total]"]; ok {
+		t.Errorf("form has a total for the unreadable filesystem: %v", form["filesystems[1][total]"])
+	}
+}
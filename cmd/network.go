@@ -0,0 +1,361 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/shirou/gopsutil/net"
+)
+
+// netIOFile keeps the interface counters from the previous monitor run
+const netIOFile = "net-io.json"
+
+// sshdConfigFile is read to find the ports sshd listens on
+var sshdConfigFile = "/etc/ssh/sshd_config"
+
+// procNetTCPFiles list every Linux TCP socket. Reading them is much cheaper
+// than asking gopsutil, which also looks through every process's open files
+// to find the socket owners.
+var procNetTCPFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// tcpStates names the socket states in /proc/net/tcp the way gopsutil does
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED", "02": "SYN_SENT", "03": "SYN_RECV", "04": "FIN_WAIT1",
+	"05": "FIN_WAIT2", "06": "TIME_WAIT", "07": "CLOSE", "08": "CLOSE_WAIT",
+	"09": "LAST_ACK", "0A": "LISTEN", "0B": "CLOSING",
+}
+
+// tcpConnection is the state and local port of a TCP socket
+type tcpConnection struct {
+	Status    string
+	LocalPort uint32
+}
+
+// netIOSample is the contents of the interface counters state file
+type netIOSample struct {
+	Time     time.Time                     `json:"time"`
+	Counters map[string]net.IOCountersStat `json:"counters"`
+}
+
+// networkCollector reports network interfaces and connections
+type networkCollector struct{}
+
+func (networkCollector) Name() string { return "network" }
+
+func (networkCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	var err error
+	p.Network, err = collectNetworkMetrics(ctx, state)
+	return err
+}
+
+// collectNetworkMetrics reports the traffic on every interface other than
+// loopback, and counts TCP connections and SSH sessions.
+func collectNetworkMetrics(ctx context.Context, state collectorState) (*metrics.Network, error) {
+	result := &metrics.Network{Interfaces: []metrics.Interface{}, TCPConnections: map[string]int{}}
+
+	interfaces, err := net.InterfacesWithContext(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return result, err
+	}
+
+	current := netIOSample{Time: time.Now(), Counters: map[string]net.IOCountersStat{}}
+	for _, counter := range counters {
+		current.Counters[counter.Name] = counter
+	}
+
+	var previous netIOSample
+	if err := readState(netIOFile, &previous); err != nil {
+		return result, err
+	}
+	state[netIOFile] = &current
+	elapsed := current.Time.Sub(previous.Time).Seconds()
+
+	for _, iface := range interfaces {
+		if hasFlag(iface.Flags, "loopback") {
+			continue
+		}
+
+		m := metrics.Interface{Name: iface.Name, Addresses: []string{}}
+		for _, addr := range iface.Addrs {
+			m.Addresses = append(m.Addresses, addr.Addr)
+		}
+
+		before, ok := previous.Counters[iface.Name]
+		after, found := current.Counters[iface.Name]
+
+		// The counters start again from zero when the interface or server restarts
+		if ok && found && !previous.Time.IsZero() && elapsed > 0 && after.BytesRecv >= before.BytesRecv && after.BytesSent >= before.BytesSent {
+			rate := func(before, after uint64) float64 {
+				if after < before {
+					return 0
+				}
+				return float64(after-before) / elapsed
+			}
+
+			m.Traffic = &metrics.InterfaceTraffic{
+				BytesInPerSecond:    rate(before.BytesRecv, after.BytesRecv),
+				BytesOutPerSecond:   rate(before.BytesSent, after.BytesSent),
+				PacketsInPerSecond:  rate(before.PacketsRecv, after.PacketsRecv),
+				PacketsOutPerSecond: rate(before.PacketsSent, after.PacketsSent),
+				ErrorsInPerSecond:   rate(before.Errin, after.Errin),
+				ErrorsOutPerSecond:  rate(before.Errout, after.Errout),
+				DropsInPerSecond:    rate(before.Dropin, after.Dropin),
+				DropsOutPerSecond:   rate(before.Dropout, after.Dropout),
+			}
+		}
+
+		result.Interfaces = append(result.Interfaces, m)
+	}
+
+	connections, err := tcpConnections(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	sshPorts := sshdPorts()
+	for _, conn := range connections {
+		result.TCPConnections[conn.Status]++
+
+		if conn.Status == "ESTABLISHED" && sshPorts[conn.LocalPort] {
+			result.SSHSessions++
+		}
+	}
+
+	return result, nil
+}
+
+// tcpConnections returns every TCP socket, from /proc/net when it exists
+// and from gopsutil otherwise.
+func tcpConnections(ctx context.Context) ([]tcpConnection, error) {
+	if _, err := os.Stat(procNetTCPFiles[0]); os.IsNotExist(err) {
+		stats, err := net.ConnectionsWithoutUidsWithContext(ctx, "tcp")
+		if err != nil {
+			return nil, err
+		}
+
+		connections := make([]tcpConnection, len(stats))
+		for i, stat := range stats {
+			connections[i] = tcpConnection{Status: stat.Status, LocalPort: stat.Laddr.Port}
+		}
+		return connections, nil
+	}
+
+	var connections []tcpConnection
+	for _, path := range procNetTCPFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			// IPv6 can be disabled on the kernel command line
+			if os.IsNotExist(err) {
+				continue
+			}
+			return connections, err
+		}
+
+		found, err := parseProcNetTCP(f)
+		f.Close()
+		if err != nil {
+			return connections, fmt.Errorf("unable to read %s: %v", path, err)
+		}
+		connections = append(connections, found...)
+	}
+
+	return connections, nil
+}
+
+// parseProcNetTCP reads a /proc/net/tcp or tcp6 file, which looks like:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue ...
+//	 0: 00000000:0016 00000000:0000 0A 00000000:00000000 ...
+func parseProcNetTCP(r io.Reader) ([]tcpConnection, error) {
+	var connections []tcpConnection
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "sl" {
+			continue
+		}
+
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			return connections, fmt.Errorf("invalid local address %q", fields[1])
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			return connections, fmt.Errorf("invalid local address %q", fields[1])
+		}
+
+		status, ok := tcpStates[fields[3]]
+		if !ok {
+			status = "UNKNOWN"
+		}
+		connections = append(connections, tcpConnection{Status: status, LocalPort: uint32(port)})
+	}
+
+	return connections, scanner.Err()
+}
+
+// hasFlag reports whether an interface has the given flag set.
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// sshdListeners holds the settings that decide which ports sshd listens on
+type sshdListeners struct {
+	// Ports are from the Port settings
+	Ports map[uint32]bool
+
+	// AddressPorts are from ListenAddress settings with a port
+	AddressPorts map[uint32]bool
+
+	// Addresses counts the ListenAddress settings, with or without a port
+	Addresses int
+
+	// AddressesWithoutPort counts the ListenAddress settings that use the
+	// Port settings
+	AddressesWithoutPort int
+}
+
+// sshdPorts returns the ports sshd listens on, from its config file and any
+// files it includes. sshd uses port 22 when none are set.
+func sshdPorts() map[uint32]bool {
+	listeners := sshdListeners{Ports: map[uint32]bool{}, AddressPorts: map[uint32]bool{}}
+	readSSHDPorts(sshdConfigFile, &listeners, 0)
+	return listeners.ports()
+}
+
+// ports works out the ports sshd listens on. A ListenAddress with a port
+// overrides the Port settings for that address, so they are only used when
+// there is a ListenAddress without a port, or none at all.
+func (l sshdListeners) ports() map[uint32]bool {
+	ports := map[uint32]bool{}
+	for port := range l.AddressPorts {
+		ports[port] = true
+	}
+
+	if l.Addresses == 0 || l.AddressesWithoutPort > 0 {
+		for port := range l.Ports {
+			ports[port] = true
+		}
+		if len(l.Ports) == 0 {
+			ports[22] = true
+		}
+	}
+
+	return ports
+}
+
+// readSSHDPorts adds the Port and ListenAddress settings from an sshd config
+// file to listeners, following Include directives a few levels deep.
+func readSSHDPorts(path string, listeners *sshdListeners, depth int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "port":
+			if port, err := strconv.ParseUint(fields[1], 10, 16); err == nil {
+				listeners.Ports[uint32(port)] = true
+			}
+
+		case "listenaddress":
+			listeners.Addresses++
+			if port, ok := listenAddressPort(fields[1]); ok {
+				listeners.AddressPorts[port] = true
+			} else {
+				listeners.AddressesWithoutPort++
+			}
+
+		case "include":
+			if depth >= 4 {
+				continue
+			}
+			for _, pattern := range fields[1:] {
+				// Relative includes are relative to /etc/ssh
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(sshdConfigFile), pattern)
+				}
+				matches, _ := filepath.Glob(pattern)
+				for _, match := range matches {
+					readSSHDPorts(match, listeners, depth+1)
+				}
+			}
+
+		case "match":
+			// Port and ListenAddress can't be set inside a Match block, so
+			// there is nothing more to find
+			return
+		}
+	}
+}
+
+// listenAddressPort returns the port of a ListenAddress setting, which can
+// be host, host:port, an IPv6 address or [address]:port.
+func listenAddressPort(address string) (uint32, bool) {
+	var port string
+	if strings.HasPrefix(address, "[") {
+		i := strings.Index(address, "]:")
+		if i < 0 {
+			return 0, false
+		}
+		port = address[i+2:]
+	} else if strings.Count(address, ":") == 1 {
+		port = address[strings.Index(address, ":")+1:]
+	} else {
+		return 0, false
+	}
+
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(value), true
+}
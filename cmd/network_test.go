@@ -0,0 +1,222 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSSHDPorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []uint32
+	}{
+		{
+			name:  "default port",
+			files: map[string]string{"sshd_config": "# Port 22\nPermitRootLogin no\n"},
+			want:  []uint32{22},
+		},
+		{
+			name:  "ports",
+			files: map[string]string{"sshd_config": "Port 2222\nport 2223\n"},
+			want:  []uint32{2222, 2223},
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"sshd_config":                 "Include sshd_config.d/*.conf\n",
+				"sshd_config.d/10-port.conf":  "Port 2222\n",
+				"sshd_config.d/20-other.conf": "PasswordAuthentication no\n",
+			},
+			want: []uint32{2222},
+		},
+		{
+			name: "nested include",
+			files: map[string]string{
+				"sshd_config": "Include first.conf\n",
+				"first.conf":  "Include second.conf\n",
+				"second.conf": "Port 2200\n",
+			},
+			want: []uint32{2200},
+		},
+		{
+			name:  "match block",
+			files: map[string]string{"sshd_config": "Port 2222\nMatch User backup\n    Port 2223\n"},
+			want:  []uint32{2222},
+		},
+		{
+			name: "match block in an include",
+			files: map[string]string{
+				"sshd_config": "Include users.conf\nPort 2222\n",
+				"users.conf":  "Match Group sftp\n    ForceCommand internal-sftp\n",
+			},
+			want: []uint32{2222},
+		},
+		{
+			name:  "listen address with a port",
+			files: map[string]string{"sshd_config": "Port 2222\nListenAddress 10.0.0.1:2200\n"},
+			want:  []uint32{2200},
+		},
+		{
+			name:  "listen address without a port",
+			files: map[string]string{"sshd_config": "Port 2222\nListenAddress 10.0.0.1\n"},
+			want:  []uint32{2222},
+		},
+		{
+			name:  "listen address without a port or Port",
+			files: map[string]string{"sshd_config": "ListenAddress 0.0.0.0\nListenAddress ::\n"},
+			want:  []uint32{22},
+		},
+		{
+			name:  "listen addresses with and without ports",
+			files: map[string]string{"sshd_config": "Port 2222\nListenAddress 10.0.0.1\nListenAddress [fd00::1]:2200\n"},
+			want:  []uint32{2200, 2222},
+		},
+		{
+			name:  "listen address with a routing domain",
+			files: map[string]string{"sshd_config": "ListenAddress 10.0.0.1:2200 rdomain vrf1\n"},
+			want:  []uint32{2200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			previous := sshdConfigFile
+			sshdConfigFile = filepath.Join(dir, "sshd_config")
+			defer func() { sshdConfigFile = previous }()
+
+			want := map[uint32]bool{}
+			for _, port := range tt.want {
+				want[port] = true
+			}
+			if got := sshdPorts(); !reflect.DeepEqual(got, want) {
+				t.Errorf("sshdPorts() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestListenAddressPort(t *testing.T) {
+	tests := []struct {
+		address string
+		port    uint32
+		ok      bool
+	}{
+		{address: "0.0.0.0", ok: false},
+		{address: "10.0.0.1:2222", port: 2222, ok: true},
+		{address: "host.example.com:22", port: 22, ok: true},
+		{address: "::", ok: false},
+		{address: "fd00::1", ok: false},
+		{address: "[fd00::1]:2200", port: 2200, ok: true},
+		{address: "[fd00::1]", ok: false},
+		{address: "10.0.0.1:ssh", ok: false},
+		{address: "10.0.0.1:70000", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			port, ok := listenAddressPort(tt.address)
+			if port != tt.port || ok != tt.ok {
+				t.Errorf("listenAddressPort(%q) = %d, %v, want %d, %v", tt.address, port, ok, tt.port, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []tcpConnection
+		wantErr bool
+	}{
+		{
+			name: "tcp",
+			input: `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21341 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0277 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 19842 1 0000000000000000 100 0 0 10 0
+   2: 0A00000F:0016 0A000001:D8B4 01 00000000:00000000 02:0009E2A5 00000000     0        0 88231 2 0000000000000000 20 4 31 10 -1
+   3: 0A00000F:9C40 5DB8D822:01BB 06 00000000:00000000 03:00000F5E 00000000     0        0 0 3 0000000000000000
+`,
+			want: []tcpConnection{
+				{Status: "LISTEN", LocalPort: 22},
+				{Status: "LISTEN", LocalPort: 631},
+				{Status: "ESTABLISHED", LocalPort: 22},
+				{Status: "TIME_WAIT", LocalPort: 40000},
+			},
+		},
+		{
+			name: "tcp6",
+			input: `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0016 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21343 1 0000000000000000 100 0 0 10 0
+   1: 0000000000000000FFFF00000A00000F:0016 0000000000000000FFFF00000A000001:E1C2 08 00000000:00000000 00:00000000 00000000     0        0 91023 1 0000000000000000 20 4 30 10 -1
+`,
+			want: []tcpConnection{
+				{Status: "LISTEN", LocalPort: 22},
+				{Status: "CLOSE_WAIT", LocalPort: 22},
+			},
+		},
+		{
+			name:  "empty",
+			input: "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n",
+		},
+		{
+			name:    "invalid port",
+			input:   "   0: 00000000:XYZ 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21341 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing port",
+			input:   "   0: 00000000 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21341 1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProcNetTCP(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseProcNetTCP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProcNetTCP() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
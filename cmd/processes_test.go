@@ -0,0 +1,99 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedactCommand(t *testing.T) {
+	var redactions []*regexp.Regexp
+	for _, pattern := range defaultRedactions {
+		redactions = append(redactions, regexp.MustCompile(pattern))
+	}
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		// Options and variables named after secrets
+		{"app --password=hunter2 --port=80", "app --password=[redacted] --port=80"},
+		{"app --password hunter2 --verbose", "app --password [redacted] --verbose"},
+		{"app -token abc123", "app -token [redacted]"},
+		{"env DB_PASSWORD=hunter2 PGPASSWORD=hunter2 app", "env DB_PASSWORD=[redacted] PGPASSWORD=[redacted] app"},
+		{"app --api-key=abc --apikey abc", "app --api-key=[redacted] --apikey [redacted]"},
+		{"app --password-file=/etc/app/secret", "app --password-file=[redacted]"},
+		{"app --auth=user:pass --auth-token xyz", "app --auth=[redacted] --auth-token [redacted]"},
+		{"app SECRET_KEY=abc client_secret: abc", "app SECRET_KEY=[redacted] client_secret: [redacted]"},
+		{"app --passphrase -", "app --passphrase -"},
+
+		// Names that only start like a secret's
+		{"git log --author=alice", "git log --author=alice"},
+		{"git log --author alice", "git log --author alice"},
+		{"app --passenger=1 --authority example.com", "app --passenger=1 --authority example.com"},
+		{"app --tokenizer=simple", "app --tokenizer=simple"},
+
+		// Credentials in URLs
+		{"psql postgres://app:hunter2@db/app", "psql postgres://app:[redacted]@db/app"},
+		{"git clone https://github.com/org/repo", "git clone https://github.com/org/repo"},
+
+		// mysql -p<secret>
+		{"mysql -uroot -phunter2 app", "mysql -uroot -p[redacted] app"},
+		{"/usr/bin/mysqldump -u root -phunter2 --all-databases", "/usr/bin/mysqldump -u root -p[redacted] --all-databases"},
+		{"mysql -u root -p app", "mysql -u root -p app"},
+		{"mariadb-dump -phunter2", "mariadb-dump -p[redacted]"},
+		{"docker run -p8080:80 nginx", "docker run -p8080:80 nginx"},
+
+		// redis-cli -a <secret>
+		{"redis-cli -h cache -a hunter2 ping", "redis-cli -h cache -a [redacted] ping"},
+		{"/usr/local/bin/redis-cli -a hunter2", "/usr/local/bin/redis-cli -a [redacted]"},
+		{"ls -a /tmp", "ls -a /tmp"},
+
+		{"sshd: root@pts/0", "sshd: root@pts/0"},
+	}
+
+	for _, tt := range tests {
+		if got := redactCommand(tt.command, redactions); got != tt.want {
+			t.Errorf("redactCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestRedactCommandCustomPattern(t *testing.T) {
+	redactions := []*regexp.Regexp{regexp.MustCompile(`--db-url=(\S+)`), regexp.MustCompile(`hunter\d`)}
+
+	got := redactCommand("app --db-url=mysql://db/app hunter2", redactions)
+	if want := "app --db-url=[redacted] [redacted]"; got != want {
+		t.Errorf("redactCommand() = %q, want %q", got, want)
+	}
+}
+
+func TestRedactCommandTruncates(t *testing.T) {
+	command := strings.Repeat("a", maxCommandLength-1) + "é and more"
+
+	got := redactCommand(command, nil)
+	if want := strings.Repeat("a", maxCommandLength-1) + "..."; got != want {
+		t.Errorf("redactCommand() = %q, want the command cut before the multi-byte character", got)
+	}
+}
@@ -22,14 +22,21 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"fmt"
+	"os"
 	"os/user"
-    "fmt"
-    "time"
+	"strings"
+
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+var purge bool
+var restore bool
+var merge bool
+var removeProfile string
+
 // removeCmd represents the remove command
 var removeCmd = &cobra.Command{
 	Use:   "remove",
@@ -43,47 +50,222 @@ var removeCmd = &cobra.Command{
 			return
 		}
 
-        // Sleep for 1 second.
-        time.Sleep(1 * time.Second)
+		if _, profileErr := selectProfiles(removeProfile); profileErr != nil {
+			color.Red("%s", profileErr.Error())
+			os.Exit(1)
+		}
 
-		if err := viper.ReadInConfig(); err != nil {
-        	fmt.Println("Failed to read the config file:", viper.ConfigFileUsed())
-        }
+		// Work on the profile that manages the user, unless told otherwise
+		target := removeProfile
+		if claimed, _, ok := accountProfile(viper.GetViper(), username); ok {
+			if len(target) > 0 && target != claimed {
+				color.Red("The user %s is managed by the %s profile, not %s.", username, claimed, target)
+				os.Exit(1)
+			}
+			target = claimed
+		} else if restore || purge {
+			// The keys file of a user ServerAuth never managed isn't ours to change
+			color.Red("The user %s is not managed by ServerAuth, so --restore and --purge can't be used.", username)
+			os.Exit(1)
+		} else if len(target) == 0 {
+			target = profileNames(viper.GetViper())[0]
+		}
 
-		// Load existing accounts from config
-		var accounts []Account
-		configErr := viper.UnmarshalKey("accounts", &accounts)
+		// Remove the account and update the config
+		// Loop over accounts and search for the username
+		var removedAccount *Account
+		configErr := updateAccounts(target, func(accounts []Account) ([]Account, error) {
+			var updatedAccounts []Account
+			for i, data := range accounts {
+				if data.Username != username {
+					updatedAccounts = append(updatedAccounts, data)
+				} else {
+					removedAccount = &accounts[i]
+				}
+			}
+			return updatedAccounts, nil
+		})
 
 		if configErr != nil {
-			panic("There was a problem setting up the user account. Please try again or contact ServerAuth for assistance")
+			color.Red("Unable to remove the account from the ServerAuth config: %s", configErr)
+			os.Exit(1)
+		}
+		if removedAccount == nil && (restore || purge) {
+			color.Red("The user %s was not found in the %s profile, so the authorized_keys file has been left in place.", username, target)
+			os.Exit(1)
 		}
 
+		color.Green("\nThe selected account has been removed from ServerAuth.")
 
-		// Remove the account and update the config
-		// Loop over accounts and search for the username
-		var updatedAccounts []Account
-		for _, data := range accounts {
-			if data.Username != username {
-				updatedAccounts = append(updatedAccounts, Account{data.Username, data.ApiKey})
-			}
+		// Any sudo access granted through ServerAuth goes with the account
+		if err := removeSudoers(u.Username); err != nil {
+			color.Red("\nUnable to remove the sudo policy %s: %s", sudoersFile(u.Username), err)
 		}
 
-		// Save the updated accounts list
-		viper.Set("accounts", updatedAccounts)
+		// Decide what happens to the managed authorized_keys file
+		keysResult := "The authorized_keys file has been left in tact to allow you to manually update it."
+		if restore {
+			keysResult, err = restoreKeysBackup(u, merge)
+		} else if purge {
+			keysResult, err = purgeKeysFile(u)
+		}
 
-		// Sleep for 1 second to allow the config to be written on slower systems
-        time.Sleep(1 * time.Second)
+		if err != nil {
+			color.Red("\n%s", err)
+			writeAudit("remove", u.Username, "account removed, keys file not changed: "+err.Error())
+			os.Exit(1)
+		}
 
-		viper.WriteConfig()
-		color.Green("\nThe selected account has been removed from ServerAuth.")
-		color.Green("\nThe authorized_keys file has been left in tact to allow you to manually update it.")
+		color.Green("\n%s", keysResult)
+		writeAudit("remove", u.Username, "account removed, "+keysResult)
+
+		if !purge {
+			return
+		}
+
+		// Delete the system user, but only if ServerAuth created it
+		if removedAccount == nil || !removedAccount.UserCreated {
+			color.Yellow("\nThe system user %s was not created by ServerAuth, so it has been left in place.", u.Username)
+			return
+		}
+
+		if err := deleteSystemUser(u.Username); err != nil {
+			color.Red("\nUnable to delete the system user %s: %s", u.Username, err)
+			os.Exit(1)
+		}
+		color.Green("\nThe system user %s has been deleted. Its home directory has been left in place.", u.Username)
+		writeAudit("purge-user", u.Username, "system user deleted")
 	},
 }
 
+// restoreKeysBackup puts the authorized_keys file from before ServerAuth was
+// set up back in place, optionally keeping the keys currently installed. The
+// backup chosen by originalBackup is used, falling back to the
+// authorized_keys.bak file left by older versions of the agent.
+func restoreKeysBackup(u *user.User, merge bool) (string, error) {
+	keysDir, err := openSSHDir(u, false)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open the .ssh directory for %s: %s", u.Username, err)
+	}
+	defer keysDir.Close()
+
+	original, source, err := originalKeys(keysDir, u.Username)
+	if err != nil {
+		return "", err
+	}
+	if original == nil {
+		return "No backup of the original authorized_keys file was found, so it has been left in tact.", nil
+	}
+
+	result := "The original authorized_keys file has been restored from " + source + "."
+	if merge {
+		current, err := keysDir.ReadFile("authorized_keys")
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("Unable to read the current authorized_keys file: %s", err)
+		}
+		original = mergeKeys(original, current)
+		result = "The original authorized_keys file has been restored from " + source + " and merged with the keys ServerAuth installed."
+	}
+
+	if _, err := backupKeysFile(keysDir, u.Username, "remove", original); err != nil {
+		return "", fmt.Errorf("Unable to back up the current authorized_keys file: %s", err)
+	}
+
+	if err := keysDir.WriteFile("authorized_keys", original, 0600); err != nil {
+		return "", fmt.Errorf("Unable to restore the authorized_keys file: %s", err)
+	}
+
+	return result, nil
+}
+
+// originalKeys finds the authorized_keys contents from before the account
+// was added, returning nil if there are none.
+func originalKeys(keysDir *sshDir, username string) ([]byte, string, error) {
+	backups, err := listKeysBackups(username)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read the backup index: %s", err)
+	}
+
+	if i := originalBackup(backups, username); i >= 0 {
+		contents, err := readKeysBackup(&backups[i])
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to read the authorized_keys backup: %s", err)
+		}
+		return contents, "backup " + backups[i].ID, nil
+	}
+
+	legacy, err := keysDir.ReadFile("authorized_keys.bak")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("Unable to read the authorized_keys backup: %s", err)
+	}
+	return legacy, keysDir.Path("authorized_keys.bak"), nil
+}
+
+// purgeKeysFile deletes the authorized_keys file managed by ServerAuth,
+// keeping a backup of it first.
+func purgeKeysFile(u *user.User) (string, error) {
+	keysDir, err := openSSHDir(u, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "There was no authorized_keys file to delete.", nil
+		}
+		return "", fmt.Errorf("Unable to open the .ssh directory for %s: %s", u.Username, err)
+	}
+	defer keysDir.Close()
+
+	if _, err := backupKeysFile(keysDir, u.Username, "remove", nil); err != nil {
+		return "", fmt.Errorf("Unable to back up the authorized_keys file: %s", err)
+	}
+
+	if err := keysDir.Remove("authorized_keys"); err != nil {
+		if os.IsNotExist(err) {
+			return "There was no authorized_keys file to delete.", nil
+		}
+		return "", fmt.Errorf("Unable to delete the authorized_keys file: %s", err)
+	}
+
+	return "The authorized_keys file " + keysDir.Path("authorized_keys") + " has been deleted.", nil
+}
+
+// mergeKeys appends the keys from current that are missing from backup.
+// Comments, such as the ServerAuth markers, are not carried over.
+func mergeKeys(backup, current []byte) []byte {
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(backup), "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+
+	merged := strings.TrimRight(string(backup), "\n") + "\n"
+	for _, line := range strings.Split(string(current), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") || existing[line] {
+			continue
+		}
+		merged += line + "\n"
+		existing[line] = true
+	}
+
+	return []byte(merged)
+}
+
 func init() {
 	rootCmd.AddCommand(removeCmd)
 
 	// User flag
 	removeCmd.Flags().StringVarP(&username, "username", "u", "", "The username of the system account to add to ServerAuth")
 	removeCmd.MarkFlagRequired("username")
+
+	// Purge flag
+	removeCmd.Flags().BoolVar(&purge, "purge", false, "Delete the managed authorized_keys file, and the system account if it was created by ServerAuth")
+
+	// Restore flags
+	removeCmd.Flags().BoolVar(&restore, "restore", false, "Restore the authorized_keys file from before the account was added to ServerAuth")
+	removeCmd.Flags().BoolVar(&merge, "merge", false, "When restoring, also keep the keys currently installed by ServerAuth")
+	removeCmd.MarkFlagsMutuallyExclusive("restore", "purge")
+
+	// Profile flag
+	removeCmd.Flags().StringVar(&removeProfile, "profile", "", "The profile the account belongs to. By default, whichever profile manages the user")
 }
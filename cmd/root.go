@@ -24,6 +24,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -35,6 +36,16 @@ var cfgFile string
 type Account struct {
 	Username string `yaml:"username"`
 	ApiKey   string `yaml:"apiKey"`
+
+	// Optional settings used when ServerAuth creates the system user
+	CreateUser bool     `yaml:"createUser,omitempty"`
+	Shell      string   `yaml:"shell,omitempty"`
+	Home       string   `yaml:"home,omitempty"`
+	Group      string   `yaml:"group,omitempty"`
+	Groups     []string `yaml:"groups,omitempty"`
+
+	// Set when the system user was created by ServerAuth, so it can be purged
+	UserCreated bool `yaml:"userCreated,omitempty"`
 }
 
 var keysFileTemplate = []byte(`# This file is managed by ServerAuth.\n
@@ -46,6 +57,9 @@ var rootCmd = &cobra.Command{
 	Use:   "serverauth",
 	Short: "ServerAuth Server Agent",
 	Long:  `The ServerAuth Server Agent is an easy to use command line application, allowing your server to automatically sync your teams SSH keys.`,
+
+	// Make sure the config is usable before any command runs
+	PersistentPreRun: checkConfig,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -59,19 +73,28 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is /etc/serverauth/config.yaml, or $SERVERAUTH_CONFIG)")
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	viper.AddConfigPath("/etc/serverauth")
-	viper.SetConfigName("config")
+	if len(cfgFile) == 0 {
+		cfgFile = os.Getenv("SERVERAUTH_CONFIG")
+	}
+
+	if len(cfgFile) > 0 {
+		// Use the config file given by the flag or environment
+		viper.SetConfigFile(cfgFile)
+	} else {
+		viper.AddConfigPath("/etc/serverauth")
+		viper.SetConfigName("config")
+	}
 	viper.SetConfigType("yaml")
 
+	// Settings can be overridden with environment variables, e.g.
+	// SERVERAUTH_ORGID for orgid and SERVERAUTH_TEAM_ENABLED for team.enabled
+	viper.SetEnvPrefix("serverauth")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	// if err := viper.ReadInConfig(); err != nil {
-	// 	color.Red("Your server is not configured to use ServerAuth!")
-	// 	fmt.Println("Please follow the instructions on your server details page inside your ServerAuth account, or contact us for assistance.", viper.ConfigFileUsed())
-	// }
 }
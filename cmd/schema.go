@@ -0,0 +1,542 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// schemaKind is the type of value a config setting holds
+type schemaKind int
+
+const (
+	kindString schemaKind = iota
+	kindBool
+	kindInt
+	kindList
+	kindMap
+)
+
+func (k schemaKind) String() string {
+	return [...]string{"a string", "true or false", "a whole number", "a list", "a set of settings"}[k]
+}
+
+// schemaField describes a single config setting
+type schemaField struct {
+	Kind     schemaKind
+	Required bool
+
+	// Secret settings may hold a file:, env: or credential: reference, and
+	// must not be stored literally in a world-readable file
+	Secret bool
+
+	// Check validates the format of a scalar, returning a problem or ""
+	Check func(value string) string
+
+	// Fields are the settings allowed inside a map
+	Fields map[string]*schemaField
+
+	// Values describes every entry of a map whose keys are names chosen by
+	// the user, each of which must pass NameCheck
+	Values    *schemaField
+	NameCheck func(name string) string
+
+	// Merged maps can be spread over several files and environment
+	// variables, so their required settings are checked by validateConfig
+	// once everything has been merged
+	Merged bool
+
+	// Items describes every entry of a list, and Unique names a setting
+	// that must not repeat between entries
+	Items  *schemaField
+	Unique string
+}
+
+// configProblem is a single problem found in the config
+type configProblem struct {
+	File    string
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p configProblem) String() string {
+	location := p.File
+	if p.Line > 0 {
+		location += ":" + strconv.Itoa(p.Line)
+	}
+	if len(p.Path) > 0 {
+		return fmt.Sprintf("%s: %s: %s", location, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", location, p.Message)
+}
+
+// usernamePattern matches the system usernames ServerAuth can manage
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*\$?$`)
+
+// checkUsername validates a system username.
+func checkUsername(value string) string {
+	if !usernamePattern.MatchString(value) {
+		return "must be a valid system username"
+	}
+	return ""
+}
+
+// checkBaseDomain validates the API url override.
+func checkBaseDomain(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return "must be an http or https url, e.g. https://api.serverauth.com/"
+	}
+	if !strings.HasSuffix(value, "/") {
+		return "must end with a /"
+	}
+	return ""
+}
+
+// checkAbsolutePath validates a file system path.
+func checkAbsolutePath(value string) string {
+	if !filepath.IsAbs(value) {
+		return "must be an absolute path"
+	}
+	return ""
+}
+
+// checkNotEmpty validates that a string has a value.
+func checkNotEmpty(value string) string {
+	if len(strings.TrimSpace(value)) == 0 {
+		return "must not be empty"
+	}
+	return ""
+}
+
+// checkMinimum returns a check that an integer is at least min.
+func checkMinimum(min int) func(string) string {
+	return func(value string) string {
+		if n, err := strconv.Atoi(value); err != nil || n < min {
+			return fmt.Sprintf("must be %d or more", min)
+		}
+		return ""
+	}
+}
+
+// checkConfigVersion validates the config layout version.
+func checkConfigVersion(value string) string {
+	if n, err := strconv.Atoi(value); err != nil || n < 0 || n > currentConfigVersion {
+		return fmt.Sprintf("must be between 0 and %d. Newer versions need a newer agent", currentConfigVersion)
+	}
+	return ""
+}
+
+// profileNamePattern matches profile names. Viper lowercases map keys, so
+// upper case names could not be told apart.
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// checkProfileName validates the name of a profile.
+func checkProfileName(name string) string {
+	if name == defaultProfile {
+		return "is used by the top level settings, so please choose another name"
+	}
+	if !profileNamePattern.MatchString(name) {
+		return "must only contain lower case letters, numbers, - and _"
+	}
+	return ""
+}
+
+// checkGlob validates a glob pattern.
+func checkGlob(value string) string {
+	if _, err := filepath.Match(value, ""); err != nil {
+		return "must be a valid glob pattern"
+	}
+	return checkNotEmpty(value)
+}
+
+// checkDuration validates a length of time, e.g. 10s or 1m30s.
+func checkDuration(value string) string {
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		return "must be a length of time, e.g. 10s or 1m30s"
+	}
+	return ""
+}
+
+// checkRegexp validates a regular expression.
+func checkRegexp(value string) string {
+	if _, err := regexp.Compile(value); err != nil {
+		return "must be a valid regular expression"
+	}
+	return checkNotEmpty(value)
+}
+
+// checkOneOf returns a check that a string is one of the given values.
+func checkOneOf(values ...string) func(string) string {
+	return func(value string) string {
+		for _, v := range values {
+			if value == v {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(values, ", ")
+	}
+}
+
+// stringList is a list of plain strings
+var stringList = &schemaField{Kind: kindList, Items: &schemaField{Kind: kindString, Check: checkNotEmpty}}
+
+// globList is a list of glob patterns
+var globList = &schemaField{Kind: kindList, Items: &schemaField{Kind: kindString, Check: checkGlob}}
+
+// filesystemPatterns selects filesystems by mountpoint and type
+var filesystemPatterns = &schemaField{
+	Kind: kindMap,
+	Fields: map[string]*schemaField{
+		"mountpoints": globList,
+		"fstypes":     globList,
+	},
+}
+
+// profileSchema describes the settings of a single profile. The default
+// profile's settings are at the top level of the config.
+var profileSchema = &schemaField{
+	Kind:   kindMap,
+	Merged: true,
+	Fields: map[string]*schemaField{
+		"orgid":      {Kind: kindString, Required: true, Check: checkNotEmpty},
+		"apikey":     {Kind: kindString, Required: true, Secret: true, Check: checkSecret},
+		"teamkey":    {Kind: kindString, Secret: true, Check: checkSecret},
+		"basedomain": {Kind: kindString, Check: checkBaseDomain},
+		"accounts": {
+			Kind:   kindList,
+			Unique: "username",
+			Items: &schemaField{
+				Kind: kindMap,
+				Fields: map[string]*schemaField{
+					"username":    {Kind: kindString, Required: true, Check: checkUsername},
+					"apikey":      {Kind: kindString, Required: true, Secret: true, Check: checkSecret},
+					"createuser":  {Kind: kindBool},
+					"shell":       {Kind: kindString, Check: checkAbsolutePath},
+					"home":        {Kind: kindString, Check: checkAbsolutePath},
+					"group":       {Kind: kindString, Check: checkNotEmpty},
+					"groups":      stringList,
+					"usercreated": {Kind: kindBool},
+				},
+			},
+		},
+		"team": {
+			Kind: kindMap,
+			Fields: map[string]*schemaField{
+				"enabled":        {Kind: kindBool},
+				"shell":          {Kind: kindString, Check: checkAbsolutePath},
+				"groups":         stringList,
+				"gracedays":      {Kind: kindInt, Check: checkMinimum(0)},
+				"maxlockpercent": {Kind: kindInt, Check: checkMinimum(0)},
+			},
+		},
+	},
+}
+
+// configSchema describes every setting in config.yaml. The settings of the
+// default profile are added to it by init.
+var configSchema = &schemaField{
+	Kind:   kindMap,
+	Merged: true,
+	Fields: map[string]*schemaField{
+		"version": {Kind: kindInt, Check: checkConfigVersion},
+		"profiles": {
+			Kind:      kindMap,
+			Values:    profileSchema,
+			NameCheck: checkProfileName,
+		},
+		"backups": {
+			Kind: kindMap,
+			Fields: map[string]*schemaField{
+				"retain": {Kind: kindInt, Check: checkMinimum(1)},
+			},
+		},
+		"monitor": {
+			Kind: kindMap,
+			Fields: map[string]*schemaField{
+				"format": {Kind: kindString, Check: checkOneOf(monitorFormatJSON, monitorFormatForm)},
+				"checks": {
+					Kind:   kindList,
+					Unique: "name",
+					Items: &schemaField{
+						Kind: kindMap,
+						Fields: map[string]*schemaField{
+							"name":    {Kind: kindString, Required: true, Check: checkNotEmpty},
+							"command": {Kind: kindString, Required: true, Check: checkNotEmpty},
+							"timeout": {Kind: kindString, Check: checkDuration},
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+func init() {
+	for name, field := range profileSchema.Fields {
+		configSchema.Fields[name] = field
+	}
+	configSchema.Fields["monitor"].Fields["collectors"] = collectorSchema()
+}
+
+// validateConfig checks the main config file and every drop-in against the
+// schema, then checks the required settings are present once everything,
+// including environment variables, has been merged.
+func validateConfig() ([]configProblem, error) {
+	main := configFile()
+	files := []string{main}
+
+	dropIns, err := configDropIns(main)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, dropIns...)
+
+	var problems []configProblem
+	for _, file := range files {
+		fileProblems, err := validateConfigFile(file)
+		if err != nil {
+			if os.IsNotExist(err) && file == main {
+				problems = append(problems, configProblem{File: file, Message: "the config file does not exist"})
+				continue
+			}
+			return nil, err
+		}
+		problems = append(problems, fileProblems...)
+	}
+
+	// Every profile needs its credentials, wherever they were set
+	v := viper.GetViper()
+	claimed := map[string]string{}
+	for _, profile := range profileNames(v) {
+		// Badly named profiles have already been reported
+		if profile != defaultProfile && len(checkProfileName(profile)) > 0 {
+			continue
+		}
+
+		for _, name := range sortedFieldNames(profileSchema) {
+			key := profileKey(profile, name)
+			if profileSchema.Fields[name].Required && len(strings.TrimSpace(v.GetString(key))) == 0 {
+				problems = append(problems, configProblem{File: main, Path: key, Message: "is required"})
+			}
+		}
+
+		// A system user can only be managed by one profile
+		accounts, err := profileAccounts(v, profile)
+		if err != nil {
+			continue
+		}
+		for _, account := range accounts {
+			if other, ok := claimed[account.Username]; ok && other != profile {
+				problems = append(problems, configProblem{
+					File:    main,
+					Path:    profileKey(profile, "accounts"),
+					Message: fmt.Sprintf("%s is already managed by the %s profile", account.Username, other),
+				})
+				continue
+			}
+			claimed[account.Username] = profile
+		}
+	}
+
+	return problems, nil
+}
+
+// validateConfigFile checks a single YAML file against the schema. Settings
+// that are required are checked separately, as they may come from any file.
+func validateConfigFile(file string) ([]configProblem, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []configProblem{{File: file, Message: err.Error()}}, nil
+	}
+
+	// An empty file is valid
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	v := configValidator{file: file}
+
+	// Literal secrets may only be kept in files other users can't read
+	if info, err := os.Stat(file); err == nil && info.Mode().Perm()&0004 != 0 {
+		v.worldReadable = true
+	}
+
+	v.validate("", doc.Content[0], configSchema)
+	return v.problems, nil
+}
+
+// configValidator collects the problems found in a single config file
+type configValidator struct {
+	file          string
+	worldReadable bool
+	problems      []configProblem
+}
+
+// report records a problem at the given node.
+func (v *configValidator) report(node *yaml.Node, path, message string) {
+	v.problems = append(v.problems, configProblem{File: v.file, Line: node.Line, Path: path, Message: message})
+}
+
+// validate checks a YAML node, and everything beneath it, against field.
+func (v *configValidator) validate(path string, node *yaml.Node, field *schemaField) {
+	// An empty value is the same as leaving the setting out
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		if field.Required {
+			v.report(node, path, "is required")
+		}
+		return
+	}
+
+	switch field.Kind {
+	case kindMap:
+		if node.Kind != yaml.MappingNode {
+			v.report(node, path, "must be "+field.Kind.String())
+			return
+		}
+
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			name := strings.ToLower(key.Value)
+			childPath := joinConfigPath(path, key.Value)
+
+			child, ok := field.Fields[name]
+			if field.Values != nil {
+				// The keys are names, which are validated as they are
+				child, ok, name = field.Values, true, key.Value
+				if message := field.NameCheck(name); len(message) > 0 {
+					v.report(key, childPath, message)
+					continue
+				}
+			}
+			if !ok {
+				v.report(key, childPath, "is not a known setting")
+				continue
+			}
+			if seen[name] {
+				v.report(key, childPath, "is set more than once")
+			}
+			seen[name] = true
+
+			v.validate(childPath, value, child)
+		}
+
+		if field.Merged {
+			break
+		}
+		for _, name := range sortedFieldNames(field) {
+			if field.Fields[name].Required && !seen[name] {
+				v.report(node, joinConfigPath(path, name), "is required")
+			}
+		}
+
+	case kindList:
+		if node.Kind != yaml.SequenceNode {
+			v.report(node, path, "must be "+field.Kind.String())
+			return
+		}
+
+		unique := map[string]int{}
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			v.validate(itemPath, item, field.Items)
+
+			if len(field.Unique) == 0 || item.Kind != yaml.MappingNode {
+				continue
+			}
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				if strings.ToLower(item.Content[j].Value) != field.Unique {
+					continue
+				}
+				value := item.Content[j+1].Value
+				if first, ok := unique[value]; ok {
+					v.report(item.Content[j+1], joinConfigPath(itemPath, field.Unique), fmt.Sprintf("%s is already used by %s[%d]", value, path, first))
+				} else {
+					unique[value] = i
+				}
+			}
+		}
+
+	default:
+		if node.Kind != yaml.ScalarNode {
+			v.report(node, path, "must be "+field.Kind.String())
+			return
+		}
+
+		switch {
+		case field.Kind == kindBool && node.Tag != "!!bool":
+			v.report(node, path, "must be "+field.Kind.String())
+			return
+		case field.Kind == kindInt && node.Tag != "!!int":
+			v.report(node, path, "must be "+field.Kind.String())
+			return
+		}
+
+		if field.Check != nil {
+			if message := field.Check(node.Value); len(message) > 0 {
+				v.report(node, path, message)
+			}
+		}
+
+		if field.Secret && v.worldReadable && !isSecretReference(node.Value) {
+			v.report(node, path, "is a secret, but the file can be read by every user. Run `chmod 600` on it, or use a file:, env: or credential: reference")
+		}
+	}
+}
+
+// joinConfigPath adds a setting name to a dotted config path.
+func joinConfigPath(path, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+// sortedFieldNames returns the names of a map field's settings in order, so
+// problems are always reported the same way.
+func sortedFieldNames(field *schemaField) []string {
+	var names []string
+	for name := range field.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
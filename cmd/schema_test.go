@@ -0,0 +1,174 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		mode   os.FileMode
+		want   []configProblem
+	}{
+		{
+			name: "valid",
+			config: `version: 1
+orgid: org-123
+apikey: key
+accounts:
+  - username: deploy
+    apikey: key
+    createuser: true
+    groups: [www-data]
+backups:
+  retain: 5
+`,
+		},
+		{
+			name:   "empty file",
+			config: "",
+		},
+		{
+			name: "unknown keys",
+			config: `orgid: org-123
+colour: blue
+accounts:
+  - username: deploy
+    apikey: key
+    homedir: /srv/deploy
+backups:
+  keep: 5
+`,
+			want: []configProblem{
+				{Line: 2, Path: "colour", Message: "is not a known setting"},
+				{Line: 6, Path: "accounts[0].homedir", Message: "is not a known setting"},
+				{Line: 8, Path: "backups.keep", Message: "is not a known setting"},
+			},
+		},
+		{
+			name: "keys in any case",
+			config: `OrgID: org-123
+APIKey: key
+`,
+		},
+		{
+			name: "wrong types",
+			config: `version: latest
+orgid: [org-123]
+accounts:
+  username: deploy
+team:
+  enabled: "yes"
+  gracedays: 1.5
+backups: 5
+`,
+			want: []configProblem{
+				{Line: 1, Path: "version", Message: "must be a whole number"},
+				{Line: 2, Path: "orgid", Message: "must be a string"},
+				{Line: 4, Path: "accounts", Message: "must be a list"},
+				{Line: 6, Path: "team.enabled", Message: "must be true or false"},
+				{Line: 7, Path: "team.gracedays", Message: "must be a whole number"},
+				{Line: 8, Path: "backups", Message: "must be a set of settings"},
+			},
+		},
+		{
+			name: "required settings in list entries",
+			config: `accounts:
+  - username: deploy
+  - apikey: key
+    shell:
+`,
+			want: []configProblem{
+				{Line: 2, Path: "accounts[0].apikey", Message: "is required"},
+				{Line: 3, Path: "accounts[1].username", Message: "is required"},
+			},
+		},
+		{
+			name: "repeated settings",
+			config: `orgid: org-123
+accounts:
+  - username: deploy
+    apikey: key
+  - username: deploy
+    apikey: key
+orgid: org-456
+`,
+			want: []configProblem{
+				{Line: 5, Path: "accounts[1].username", Message: "deploy is already used by accounts[0]"},
+				{Line: 7, Path: "orgid", Message: "is set more than once"},
+			},
+		},
+		{
+			name: "literal secret in a world-readable file",
+			config: `orgid: org-123
+apikey: key
+teamkey: env:SERVERAUTH_TEAMKEY
+`,
+			mode: 0644,
+			want: []configProblem{
+				{Line: 2, Path: "apikey", Message: "is a secret, but the file can be read by every user. Run `chmod 600` on it, or use a file:, env: or credential: reference"},
+			},
+		},
+		{
+			name:   "invalid YAML",
+			config: "orgid: org-123\n  apikey: key\n",
+			want: []configProblem{
+				{Message: "yaml: line 2: mapping values are not allowed in this context"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			mode := tt.mode
+			if mode == 0 {
+				mode = 0600
+			}
+			if err := ioutil.WriteFile(file, []byte(tt.config), mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(file, mode); err != nil {
+				t.Fatal(err)
+			}
+
+			problems, err := validateConfigFile(file)
+			if err != nil {
+				t.Fatalf("validateConfigFile() error = %v", err)
+			}
+
+			for i := range tt.want {
+				tt.want[i].File = file
+			}
+			if !reflect.DeepEqual(problems, tt.want) {
+				t.Errorf("validateConfigFile() =\n%v\nwant\n%v", problems, tt.want)
+			}
+		})
+	}
+}
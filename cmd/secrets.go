@@ -0,0 +1,111 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secret settings can hold a reference instead of the secret itself:
+//
+//	file:/run/secrets/serverauth-apikey  reads the secret from a file
+//	env:SERVERAUTH_SECRET_APIKEY         reads it from an environment variable
+//	credential:serverauth-apikey         reads a systemd credential from $CREDENTIALS_DIRECTORY
+const (
+	secretFilePrefix       = "file:"
+	secretEnvPrefix        = "env:"
+	secretCredentialPrefix = "credential:"
+)
+
+// isSecretReference reports whether value refers to a secret stored elsewhere.
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) ||
+		strings.HasPrefix(value, secretEnvPrefix) ||
+		strings.HasPrefix(value, secretCredentialPrefix)
+}
+
+// resolveSecret returns the secret a setting refers to. Values that are not
+// references are returned as they are.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		return readSecretFile(strings.TrimPrefix(value, secretFilePrefix))
+
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok || len(secret) == 0 {
+			return "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+		return secret, nil
+
+	case strings.HasPrefix(value, secretCredentialPrefix):
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if len(dir) == 0 {
+			return "", fmt.Errorf("%s can only be used when the agent is run by systemd with LoadCredential", value)
+		}
+		return readSecretFile(filepath.Join(dir, strings.TrimPrefix(value, secretCredentialPrefix)))
+	}
+
+	return value, nil
+}
+
+// readSecretFile reads a secret from a file, ignoring any trailing newline.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimRight(string(data), "\r\n")
+	if len(secret) == 0 {
+		return "", fmt.Errorf("the secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// checkSecret validates a secret setting, which is either a literal value
+// or a well formed reference.
+func checkSecret(value string) string {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		if !filepath.IsAbs(strings.TrimPrefix(value, secretFilePrefix)) {
+			return "must use an absolute path after file:"
+		}
+	case strings.HasPrefix(value, secretEnvPrefix):
+		if len(strings.TrimPrefix(value, secretEnvPrefix)) == 0 {
+			return "must name an environment variable after env:"
+		}
+	case strings.HasPrefix(value, secretCredentialPrefix):
+		name := strings.TrimPrefix(value, secretCredentialPrefix)
+		if len(name) == 0 || strings.Contains(name, "/") {
+			return "must name a systemd credential after credential:"
+		}
+	default:
+		return checkNotEmpty(value)
+	}
+	return ""
+}
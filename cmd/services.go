@@ -0,0 +1,286 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/fatih/color"
+	"github.com/serverauth-com/serverauth-agent/metrics"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// systemdRunDir only exists when the server was booted with systemd
+var systemdRunDir = "/run/systemd/system"
+
+// unitSuffixes are the systemd unit types. Units named without one are
+// taken to be services.
+var unitSuffixes = []string{
+	".service", ".socket", ".target", ".timer", ".mount", ".automount",
+	".path", ".slice", ".scope", ".device", ".swap",
+}
+
+var servicesJSON bool
+var servicesAll bool
+
+// servicesCollector reports the state of the systemd units listed in its
+// units setting, and of every failed unit unless failed is false
+type servicesCollector struct{}
+
+func (servicesCollector) Name() string { return "services" }
+
+func (servicesCollector) Settings() map[string]*schemaField {
+	return map[string]*schemaField{
+		"units":  globList,
+		"failed": {Kind: kindBool},
+	}
+}
+
+func (c servicesCollector) Collect(ctx context.Context, p *metrics.Payload, state collectorState) error {
+	units, includeFailed := c.selection()
+
+	var err error
+	p.Services, err = collectServices(ctx, units, includeFailed, p.CollectedAt)
+	return err
+}
+
+// selection returns the units to report on from the config.
+func (c servicesCollector) selection() ([]string, bool) {
+	key := collectorKey(c.Name(), "failed")
+	return viper.GetStringSlice(collectorKey(c.Name(), "units")), !viper.IsSet(key) || viper.GetBool(key)
+}
+
+// collectServices asks systemd over D-Bus for the state of the given units,
+// which may be globs, and of every failed unit when includeFailed is set.
+// Nothing is reported on servers that don't run systemd.
+func collectServices(ctx context.Context, units []string, includeFailed bool, now time.Time) ([]metrics.Service, error) {
+	if _, err := os.Stat(systemdRunDir); err != nil {
+		return nil, nil
+	}
+
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to systemd: %v", err)
+	}
+	defer conn.Close()
+
+	var names, patterns []string
+	for _, unit := range units {
+		unit = unitName(unit)
+		if strings.ContainsAny(unit, "*?[") {
+			patterns = append(patterns, unit)
+		} else {
+			names = append(names, unit)
+		}
+	}
+
+	var statuses []dbus.UnitStatus
+
+	// Units named exactly are loaded if need be, so one that has stopped is
+	// still reported. Globs can only match units systemd has loaded.
+	if len(names) > 0 {
+		found, err := conn.ListUnitsByNamesContext(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, found...)
+	}
+	if len(patterns) > 0 {
+		found, err := conn.ListUnitsByPatternsContext(ctx, nil, patterns)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, found...)
+	}
+	if includeFailed {
+		found, err := conn.ListUnitsFilteredContext(ctx, []string{"failed"})
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, found...)
+	}
+
+	seen := map[string]bool{}
+	services := []metrics.Service{}
+	for _, status := range statuses {
+		if seen[status.Name] {
+			continue
+		}
+		seen[status.Name] = true
+
+		service := metrics.Service{
+			Name:        status.Name,
+			Description: status.Description,
+			LoadState:   status.LoadState,
+			ActiveState: status.ActiveState,
+			SubState:    status.SubState,
+		}
+
+		if status.LoadState != "not-found" {
+			if err := addUnitDetails(ctx, conn, status, &service, now); err != nil {
+				return services, fmt.Errorf("unable to read the state of %s: %v", status.Name, err)
+			}
+		}
+
+		services = append(services, service)
+	}
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// addUnitDetails adds when a unit last changed state and, for services, how
+// it last finished and how often it has been restarted.
+func addUnitDetails(ctx context.Context, conn *dbus.Conn, status dbus.UnitStatus, service *metrics.Service, now time.Time) error {
+	props, err := conn.GetUnitPathPropertiesContext(ctx, status.Path)
+	if err != nil {
+		return err
+	}
+
+	// systemd times are microseconds since the epoch, and 0 when unset
+	if usec, ok := props["StateChangeTimestamp"].(uint64); ok && usec > 0 {
+		changed := time.Unix(0, int64(usec)*int64(time.Microsecond))
+		service.StateChangedAt = &changed
+		if now.After(changed) {
+			service.SecondsInState = uint64(now.Sub(changed) / time.Second)
+		}
+	}
+
+	if !strings.HasSuffix(status.Name, ".service") {
+		return nil
+	}
+
+	props, err = conn.GetUnitTypePropertiesContext(ctx, status.Name, "Service")
+	if err != nil {
+		return err
+	}
+	service.Result, _ = props["Result"].(string)
+	service.Restarts, _ = props["NRestarts"].(uint32)
+
+	return nil
+}
+
+// unitName adds .service to a unit named without its type.
+func unitName(name string) string {
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return name
+		}
+	}
+	return name + ".service"
+}
+
+// formatSeconds formats a length of time in seconds for people to read,
+// e.g. 3d4h or 12m.
+func formatSeconds(seconds uint64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), (d%(24*time.Hour))/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// servicesCmd represents the services command
+var servicesCmd = &cobra.Command{
+	Use:         "services",
+	Short:       "Show the state of systemd services",
+	Long:        `Shows the systemd units monitor reports on: those listed under monitor.collectors.services.units, and every failed unit. Use --all to show every service. Exits with a non-zero status when any of them have failed.`,
+	Annotations: map[string]string{skipConfigValidation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		readConfig()
+
+		units, includeFailed := servicesCollector{}.selection()
+		if servicesAll {
+			units = append(units, "*.service")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), collectorTimeout(servicesCollector{}))
+		defer cancel()
+
+		if _, err := os.Stat(systemdRunDir); err != nil {
+			color.Red("This server isn't running systemd.")
+			os.Exit(1)
+		}
+
+		services, err := collectServices(ctx, units, includeFailed, time.Now())
+		if err != nil {
+			color.Red("Unable to read the state of the services: %s", err)
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, service := range services {
+			if service.ActiveState == "failed" {
+				failed = true
+			}
+		}
+
+		if servicesJSON {
+			out, _ := json.MarshalIndent(services, "", "  ")
+			fmt.Println(string(out))
+		} else if len(services) == 0 {
+			color.Green("No units have failed, and none are listed under monitor.collectors.services.units.")
+		} else {
+			fmt.Printf("%-40s %-10s %-12s %-10s %-10s %s\n", "UNIT", "ACTIVE", "SUB", "RESULT", "RESTARTS", "SINCE")
+			for _, service := range services {
+				since := "-"
+				if service.StateChangedAt != nil {
+					since = formatSeconds(service.SecondsInState) + " ago"
+				}
+				line := fmt.Sprintf("%-40s %-10s %-12s %-10s %-10d %s", service.Name, service.ActiveState, service.SubState, service.Result, service.Restarts, since)
+
+				switch {
+				case service.ActiveState == "failed" || service.LoadState == "not-found":
+					color.Red("%s", line)
+				case service.ActiveState != "active":
+					color.Yellow("%s", line)
+				default:
+					fmt.Println(line)
+				}
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(servicesCmd)
+
+	servicesCmd.Flags().BoolVar(&servicesJSON, "json", false, "Show the services as JSON")
+	servicesCmd.Flags().BoolVar(&servicesAll, "all", false, "Show every service, not only the monitored and failed ones")
+}
@@ -0,0 +1,217 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sudoersDir is where the per-account sudo policies are installed
+var sudoersDir = "/etc/sudoers.d"
+
+// sudoPolicy is the per-account sudo policy returned by the ServerAuth API
+type sudoPolicy struct {
+	Rules []sudoRule `json:"rules"`
+}
+
+// sudoRule is a single sudoers user specification, e.g.
+// `deploy ALL=(root) NOPASSWD: /usr/bin/systemctl restart nginx`
+type sudoRule struct {
+	Hosts      string   `json:"hosts"`
+	RunAs      string   `json:"runAs"`
+	NoPassword bool     `json:"noPassword"`
+	Commands   []string `json:"commands"`
+}
+
+// sudoHostPattern matches a single entry in a rule's host list: ALL, a host
+// name, or an IPv4 address or network
+var sudoHostPattern = regexp.MustCompile(`^(?:ALL|[A-Za-z0-9][A-Za-z0-9._-]*(?:/[0-9]{1,2})?)$`)
+
+// sudoRunAsPattern matches a single entry in a rule's run as list: ALL, a
+// user, a %group or a #uid
+var sudoRunAsPattern = regexp.MustCompile(`^(?:ALL|%?[A-Za-z0-9_][A-Za-z0-9._-]*\$?|#[0-9]+)$`)
+
+// sudoersFile returns the path of the sudoers file managed for a user. Sudo
+// skips files in sudoers.d whose names contain a dot, so dots are replaced
+// with a +, which usernames can't contain.
+func sudoersFile(username string) string {
+	return filepath.Join(sudoersDir, "serverauth-"+strings.ReplaceAll(username, ".", "+"))
+}
+
+// fetchSudoPolicy loads the sudo policy for an account. A 404 means the
+// account has no sudo access, which is returned as an empty policy.
+func fetchSudoPolicy(url string) (*sudoPolicy, error) {
+	body, err := apiGet(url)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return &sudoPolicy{}, nil
+		}
+		return nil, err
+	}
+
+	var policy sudoPolicy
+	if err := json.Unmarshal(body, &policy); err != nil {
+		return nil, fmt.Errorf("the sudo policy from the ServerAuth API was invalid: %v", err)
+	}
+
+	return &policy, nil
+}
+
+// renderSudoers turns a policy into the contents of a sudoers file.
+func renderSudoers(username string, policy *sudoPolicy) ([]byte, error) {
+	var b strings.Builder
+	b.WriteString("# This file is managed by ServerAuth.\n")
+	b.WriteString("# Any changes made will be overwritten.\n")
+
+	for _, rule := range policy.Rules {
+		if len(rule.Commands) == 0 {
+			continue
+		}
+
+		hosts, err := sudoList(rule.Hosts, sudoHostPattern)
+		if err != nil {
+			return nil, fmt.Errorf("the sudo policy for %s has invalid hosts: %v", username, err)
+		}
+		runAs, err := sudoList(rule.RunAs, sudoRunAsPattern)
+		if err != nil {
+			return nil, fmt.Errorf("the sudo policy for %s has an invalid run as user: %v", username, err)
+		}
+
+		var commands []string
+		for _, command := range rule.Commands {
+			commands = append(commands, escapeSudoCommand(strings.TrimSpace(command)))
+		}
+
+		tag := ""
+		if rule.NoPassword {
+			tag = "NOPASSWD: "
+		}
+
+		line := fmt.Sprintf("%s %s=(%s) %s%s\n", username, hosts, runAs, tag, strings.Join(commands, ", "))
+		if strings.Count(line, "\n") != 1 {
+			return nil, fmt.Errorf("the sudo policy for %s contains a line break", username)
+		}
+		b.WriteString(line)
+	}
+
+	return []byte(b.String()), nil
+}
+
+// sudoList checks a comma separated sudoers list, such as the hosts of a
+// rule, returning it in a normal form. Only plain entries matching pattern
+// are allowed, so the API can't widen a rule with negations, aliases or a
+// run as group. An empty list is ALL.
+func sudoList(value string, pattern *regexp.Regexp) (string, error) {
+	if len(strings.TrimSpace(value)) == 0 {
+		return "ALL", nil
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if !pattern.MatchString(entry) {
+			return "", fmt.Errorf("%q is not allowed", entry)
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ", "), nil
+}
+
+// escapeSudoCommand escapes the characters that sudoers treats specially in
+// command arguments.
+func escapeSudoCommand(command string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`, `=`, `\=`).Replace(command)
+}
+
+// installSudoers validates contents with `visudo -c` and atomically installs
+// it as the user's sudoers file. A policy without any rules removes the file.
+func installSudoers(username string, policy *sudoPolicy) error {
+	if !policyHasRules(policy) {
+		return removeSudoers(username)
+	}
+
+	contents, err := renderSudoers(username, policy)
+	if err != nil {
+		return err
+	}
+
+	target := sudoersFile(username)
+
+	// The temporary name contains a dot, so sudo ignores it until it's renamed
+	tmp, err := ioutil.TempFile(sudoersDir, ".serverauth-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0440); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Never install a file that sudo would reject, as that breaks sudo entirely
+	output, err := exec.Command("visudo", "-c", "-q", "-f", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("the sudo policy for %s failed validation: %v: %s", username, err, strings.TrimSpace(string(output)))
+	}
+
+	return os.Rename(tmp.Name(), target)
+}
+
+// policyHasRules reports whether the policy grants anything.
+func policyHasRules(policy *sudoPolicy) bool {
+	for _, rule := range policy.Rules {
+		if len(rule.Commands) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSudoers deletes the user's managed sudoers file, if there is one.
+func removeSudoers(username string) error {
+	if err := os.Remove(sudoersFile(username)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
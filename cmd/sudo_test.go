@@ -0,0 +1,153 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderSudoers(t *testing.T) {
+	const header = "# This file is managed by ServerAuth.\n# Any changes made will be overwritten.\n"
+
+	tests := []struct {
+		name  string
+		rules []sudoRule
+		want  string
+	}{
+		{
+			name:  "defaults to every host and user",
+			rules: []sudoRule{{Commands: []string{"/usr/bin/systemctl restart nginx"}}},
+			want:  "deploy ALL=(ALL) /usr/bin/systemctl restart nginx\n",
+		},
+		{
+			name: "hosts, run as and no password",
+			rules: []sudoRule{{
+				Hosts:      "web1,web2.example.com, 10.0.0.0/8",
+				RunAs:      "root, %www-data,#33",
+				NoPassword: true,
+				Commands:   []string{" /usr/bin/id ", "/bin/ls"},
+			}},
+			want: "deploy web1, web2.example.com, 10.0.0.0/8=(root, %www-data, #33) NOPASSWD: /usr/bin/id, /bin/ls\n",
+		},
+		{
+			name: "special characters in commands are escaped",
+			rules: []sudoRule{{
+				RunAs:    "postgres",
+				Commands: []string{`/usr/bin/psql -c SELECT\ 1,2 --set=a:b`},
+			}},
+			want: `deploy ALL=(postgres) /usr/bin/psql -c SELECT\\ 1\,2 --set\=a\:b` + "\n",
+		},
+		{
+			name: "rules without commands are skipped",
+			rules: []sudoRule{
+				{RunAs: "root"},
+				{Commands: []string{"/bin/true"}},
+			},
+			want: "deploy ALL=(ALL) /bin/true\n",
+		},
+		{
+			name:  "no rules",
+			rules: nil,
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderSudoers("deploy", &sudoPolicy{Rules: tt.rules})
+			if err != nil {
+				t.Fatalf("renderSudoers() error = %v", err)
+			}
+			if string(got) != header+tt.want {
+				t.Errorf("renderSudoers() =\n%s\nwant\n%s", got, header+tt.want)
+			}
+		})
+	}
+}
+
+// Values from the API must not be able to widen a rule, even in ways visudo
+// would accept.
+func TestRenderSudoersRejectsUnsafeValues(t *testing.T) {
+	tests := []struct {
+		name string
+		rule sudoRule
+	}{
+		{"negated host", sudoRule{Hosts: "ALL, !/bin/false"}},
+		{"run as group", sudoRule{RunAs: "ALL : ALL"}},
+		{"rule in the hosts", sudoRule{Hosts: "ALL=(ALL) ALL"}},
+		{"rule in the run as user", sudoRule{RunAs: "root) ALL, (ALL"}},
+		{"negated user", sudoRule{RunAs: "ALL, !root"}},
+		{"empty entry", sudoRule{Hosts: "web1,,web2"}},
+		{"line break in the hosts", sudoRule{Hosts: "web1\ndeploy ALL=(ALL) ALL"}},
+		{"line break in a command", sudoRule{Commands: []string{"/bin/true\ndeploy ALL=(ALL) ALL"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if rule.Commands == nil {
+				rule.Commands = []string{"/bin/true"}
+			}
+			if got, err := renderSudoers("deploy", &sudoPolicy{Rules: []sudoRule{rule}}); err == nil {
+				t.Errorf("renderSudoers() = %q, expected an error", got)
+			}
+		})
+	}
+}
+
+func TestEscapeSudoCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"/usr/bin/systemctl restart nginx", "/usr/bin/systemctl restart nginx"},
+		{"/bin/echo a,b", `/bin/echo a\,b`},
+		{"/usr/bin/env FOO=bar", `/usr/bin/env FOO\=bar`},
+		{"/bin/chown www:www /srv", `/bin/chown www\:www /srv`},
+		{`/bin/echo \,`, `/bin/echo \\\,`},
+		{"/usr/bin/less *", "/usr/bin/less *"},
+	}
+
+	for _, tt := range tests {
+		if got := escapeSudoCommand(tt.command); got != tt.want {
+			t.Errorf("escapeSudoCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestSudoersFileNamesDontCollide(t *testing.T) {
+	seen := map[string]string{}
+	for _, username := range []string{"ab", "a.b", "a_b", "a-b", "a.b$", "a..b", "a._b"} {
+		file := filepath.Base(sudoersFile(username))
+		if other, ok := seen[file]; ok {
+			t.Errorf("%s and %s share the sudoers file %s", username, other, file)
+		}
+		seen[file] = username
+
+		// Sudo skips files whose names contain a dot or end with ~
+		if strings.Contains(file, ".") || strings.HasSuffix(file, "~") {
+			t.Errorf("sudo would skip %s, the sudoers file for %s", file, username)
+		}
+	}
+}
@@ -22,13 +22,11 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"io/ioutil"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/user"
-	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -37,6 +35,17 @@ import (
 	"github.com/spf13/viper"
 )
 
+var syncProfile string
+
+// lastSyncFile records when sync last ran, for `serverauth doctor`
+const lastSyncFile = "last-sync.json"
+
+// syncRecord is the contents of the last sync state file
+type syncRecord struct {
+	FinishedAt time.Time `json:"finishedAt"`
+	Failed     bool      `json:"failed"`
+}
+
 // syncCmd represents the sync command
 var syncCmd = &cobra.Command{
 	Use:   "sync",
@@ -44,125 +53,210 @@ var syncCmd = &cobra.Command{
 	Long:  `This command will sync the authorized_keys file of each system account you have configured with ServerAuth.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Read in the existing accounts and get ready for adding another user
-		viper.ReadInConfig()
-
-		var accounts []Account
-		configErr := viper.UnmarshalKey("accounts", &accounts)
+		readConfig()
 
-		if configErr != nil {
-			color.Red("There was a problem setting up the user account.\nPlease try again or contact ServerAuth for assistance.")
+		profiles, profileErr := selectProfiles(syncProfile)
+		if profileErr != nil {
+			color.Red("%s", profileErr.Error())
 			os.Exit(1)
 		}
 
-		// Get the organisation id
-		var orgId string
-		viper.UnmarshalKey("orgid", &orgId)
-
-		if len(orgId) <= 0 {
-			color.Red("The organisation id is missing from your ServerAuth configuration.\nPlease check you've correctly configured ServerAuth on this server and try again.")
-			os.Exit(1)
+		failed := false
+		for _, profile := range profiles {
+			if len(profiles) > 1 {
+				color.Green("Syncing the %s profile", profile)
+			}
+			if !syncProfileAccounts(profile) {
+				failed = true
+			}
 		}
 
-		// Get the server api key
-		var serverAPIKey string
-		viper.UnmarshalKey("apikey", &serverAPIKey)
+		if err := writeState(lastSyncFile, syncRecord{FinishedAt: time.Now(), Failed: failed}); err != nil {
+			color.Red("Unable to record the sync: %s", err)
+		}
 
-		if len(serverAPIKey) <= 0 {
-			color.Red("The server API key is missing.\nPlease check you've correctly configured ServerAuth on this server and try again.")
+		if failed {
 			os.Exit(1)
 		}
+	},
+}
 
-		// Get the base domain, which can optionally be overridden
-		var baseDomain string
-		viper.UnmarshalKey("basedomain", &baseDomain)
-
-		if len(baseDomain) <= 0 {
-			// No overridden base domain, fall back to the default
-			baseDomain = "https://api.serverauth.com/"
+// syncProfileAccounts syncs every account, and team member, of a profile.
+// It carries on past accounts that fail, returning false if any did.
+func syncProfileAccounts(profile string) bool {
+	accounts, configErr := profileAccounts(viper.GetViper(), profile)
+
+	if configErr != nil {
+		color.Red("There was a problem setting up the user account.\nPlease try again or contact ServerAuth for assistance.")
+		return false
+	}
+
+	server, serverErr := loadServerConfig(profile, false)
+	if serverErr != nil {
+		color.Red("%s", serverErr.Error())
+		return false
+	}
+	if server.TeamKeyErr != nil {
+		color.Yellow("%s", server.TeamKeyErr)
+	}
+
+	failed := false
+
+	// In team mode, every member of the organisation gets their own system user
+	if viper.GetBool(profileKey(profile, "team.enabled")) {
+		color.Green("Syncing team member accounts")
+		if teamErr := syncTeamMembers(server); teamErr != nil {
+			color.Red("Unable to sync team member accounts: %s", teamErr)
+			failed = true
+		}
+	}
+
+	// Loop over accounts and sync
+	for i, account := range accounts {
+
+		// Check the user exists on the server, and save into a var for later use
+		u, userErr := user.Lookup(account.Username)
+		if userErr != nil && account.CreateUser {
+			// The account asks for the user to be created when missing
+			color.Yellow("The system user %s does not exist. Lets create it now.", account.Username)
+			u, userErr = createSystemUser(account)
+			if userErr == nil {
+				if recordErr := recordCreatedUser(profile, account.Username); recordErr != nil {
+					color.Red("Unable to record the created user in the ServerAuth config: %s", recordErr)
+					removeCreatedUser(account.Username)
+					failed = true
+					continue
+				}
+				accounts[i].UserCreated = true
+			}
 		}
 
-		// Build the base url
-		baseURL := baseDomain + "keys/" + orgId + "/" + serverAPIKey + "/"
-
-		// Loop over accounts and sync
-		for _, account := range accounts {
+		if userErr != nil {
+			color.Red("Unable to find user `%s`. Please check the username, and re-create the user on ServerAuth.", account.Username)
+			failed = true
+			continue
+		}
 
-			// Check the user exists on the server, and save into a var for later use
-			u, userErr := user.Lookup(account.Username)
-			if userErr != nil {
-				color.Red("Unable to find user `%s`. Please check the username, and re-create the user on ServerAuth.", username)
-				return
-			}
+		color.Green("Loading API Key for %s from %s", account.Username, server.BaseDomain)
 
-			accountAPIURL := baseURL + account.ApiKey
-			color.Green("Loading API Key for %s from %s", account.Username, accountAPIURL)
+		var keys string
+		account, keysErr := resolveAccountKey(account)
+		if keysErr == nil {
+			keys, keysErr = fetchAccountKeys(server, account)
+		}
+		if keysErr == nil {
+			keysErr = installAccountKeys(server, account, u, keys, "sync")
+		}
 
-			// Create http client
-			httpClient := http.Client{
-				Timeout: time.Second * 10, // Maximum of 10 secs
-			}
+		if keysErr != nil {
+			color.Red("Unable to sync %s: %s", account.Username, keysErr)
+			failed = true
+			continue
+		}
 
-			// Create a request
-			req, err := http.NewRequest(http.MethodGet, accountAPIURL, nil)
-			if err != nil {
-				log.Fatal(err)
-			}
+		color.Green("Done!")
+	}
 
-			// Set our custom useragent
-			req.Header.Set("User-Agent", "ServerAuthAgent-v2.0.0;"+runtime.GOOS)
+	return !failed
+}
 
-			// Run the request
-			res, getErr := httpClient.Do(req)
-			if getErr != nil {
-				log.Fatal(getErr)
-			}
+// fetchAccountKeys downloads and validates the authorized_keys file for an
+// account from the ServerAuth API.
+func fetchAccountKeys(server serverConfig, account Account) (string, error) {
+	body, err := apiGet(server.keysURL(account))
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			return "", fmt.Errorf("the API key for %s does not belong to this organisation and server", account.Username)
+		}
+		return "", err
+	}
 
-			// Process the body
-			body, readErr := ioutil.ReadAll(res.Body)
-			if readErr != nil {
-				log.Fatal(readErr)
-			}
+	keys := string(body)
 
-			keys := string(body)
+	// Validate that they keys file was valid
+	if !validKeysFile(keys) {
+		return "", errors.New("The response from the ServerAuth api was invalid. Please contact us for assistance.")
+	}
 
-			// Validate that they keys file was valid
-			validStart := strings.Contains(keys, "START ServerAuth Managed Keys File")
-			validEnd := strings.Contains(keys, "END ServerAuth Managed Keys File")
+	return keys, nil
+}
 
-			if !validStart || !validEnd {
-				color.Red("The response from the ServerAuth api was invalid. Please contact us for assistance.")
-				os.Exit(1)
-			}
+// installAccountKeys writes the keys into the user's authorized_keys file,
+// backing up the current one first, and then syncs the account's sudo policy.
+func installAccountKeys(server serverConfig, account Account, u *user.User, keys, command string) error {
+	// Keys for this user are valid. Save file
+	// Open the .ssh directory without following symlinks, creating it if needed
+	keysDir, err := openSSHDir(u, true)
+	if err != nil {
+		return err
+	}
+	defer keysDir.Close()
+
+	color.Green("Writing to " + keysDir.Path("authorized_keys"))
+
+	// Keep a copy of the current file if it's about to change
+	backup, err := backupKeysFile(keysDir, account.Username, command, []byte(keys))
+	if err != nil {
+		return err
+	}
+	if backup != nil {
+		color.Yellow("The previous authorized_keys file has been backed up as %s", backup.ID)
+	}
+
+	// Ready to write the file, owned by the user
+	if err := keysDir.WriteFile("authorized_keys", []byte(keys), 0600); err != nil {
+		return err
+	}
+
+	// Sync the sudo policy for the account
+	policy, sudoErr := fetchSudoPolicy(server.sudoURL(account))
+	if sudoErr == nil {
+		sudoErr = installSudoers(account.Username, policy)
+	}
+	if sudoErr != nil {
+		color.Red("Unable to sync the sudo policy for %s: %s", account.Username, sudoErr)
+	}
+
+	return nil
+}
 
-			// Work out the uid and gid for chowning
-			uid, _ := strconv.Atoi(u.Uid)
-			gid, _ := strconv.Atoi(u.Gid)
-
-			// Keys for this user are valid. Save file
-			// Set up our path and file vars
-			homeDir := u.HomeDir
-			keysDir := homeDir + "/.ssh"
-			keysFile := keysDir + "/authorized_keys"
-			color.Green("Writing to " + keysFile)
-
-			// If the .ssh directory doesnt exist, create it and set it to be owned by the user
-			if _, keysDirErr := os.Stat(keysDir); os.IsNotExist(keysDirErr) {
-				color.Yellow("It looks like " + keysDir + " does not yet exist. Lets create it now.")
-				os.MkdirAll(keysDir, 0700)
-				os.Chown(keysDir, uid, gid)
-			}
+// countKeys returns the number of keys in an authorized_keys file.
+func countKeys(keys string) int {
+	count := 0
+	for _, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			count++
+		}
+	}
+	return count
+}
 
-			// Ready to write the file
-			ioutil.WriteFile(keysFile, []byte(keys), 0600)
+// validKeysFile checks that a keys file returned by the API is complete.
+func validKeysFile(keys string) bool {
+	validStart := strings.Contains(keys, "START ServerAuth Managed Keys File")
+	validEnd := strings.Contains(keys, "END ServerAuth Managed Keys File")
 
-			// Ensure the file is owned by the correct user
-			os.Chown(keysFile, uid, gid)
+	return validStart && validEnd
+}
 
-			color.Green("Done!")
+// recordCreatedUser marks an account's system user as created by
+// ServerAuth, allowing `remove --purge` to delete it later.
+func recordCreatedUser(profile, username string) error {
+	return updateAccounts(profile, func(accounts []Account) ([]Account, error) {
+		for i := range accounts {
+			if accounts[i].Username == username {
+				accounts[i].UserCreated = true
+			}
 		}
-	},
+		return accounts, nil
+	})
 }
 
 func init() {
 	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringVar(&syncProfile, "profile", "", "Only sync the accounts of this profile")
+	syncCmd.Flags().BoolVar(&confirmDepartures, "confirm-departures", false, "Lock departed team members even when more than team.maxlockpercent of them have left")
 }
@@ -0,0 +1,343 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/user"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+)
+
+// teamStateFile records the members that team mode has provisioned for the
+// default profile. Other profiles keep their own team-members-<name>.json.
+const teamStateFile = "team-members.json"
+
+// defaultTeamGraceDays is how long a departed member stays locked before
+// their system user is deleted
+const defaultTeamGraceDays = 30
+
+// defaultTeamMaxLockPercent is the largest share of the active team users
+// that may be locked by a single sync
+const defaultTeamMaxLockPercent = 50
+
+// confirmDepartures allows a sync to lock more team users than
+// team.maxlockpercent allows
+var confirmDepartures bool
+
+// validUsername matches the usernames useradd accepts by default
+var validUsername = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// teamMember is a single member of the organisation, as returned by the API
+type teamMember struct {
+	Username string   `json:"username"`
+	Keys     string   `json:"keys"`
+	Groups   []string `json:"groups"`
+}
+
+// teamMembersResponse is the member list for this server
+type teamMembersResponse struct {
+	Members []teamMember `json:"members"`
+}
+
+// teamMemberState is what we remember about a member between syncs
+type teamMemberState struct {
+	CreatedAt  time.Time  `json:"createdAt"`
+	DepartedAt *time.Time `json:"departedAt,omitempty"`
+}
+
+// teamState is the contents of the team state file
+type teamState struct {
+	Members map[string]*teamMemberState `json:"members"`
+}
+
+// teamStateName returns the name of a profile's team state file.
+func teamStateName(profile string) string {
+	if profile == defaultProfile {
+		return teamStateFile
+	}
+	return "team-members-" + profile + ".json"
+}
+
+// syncTeamMembers creates, updates and locks one system user per member of
+// a profile's organisation. Only users created by team mode for the same
+// profile are ever modified.
+func syncTeamMembers(server serverConfig) error {
+	stateName := teamStateName(server.Profile)
+
+	body, err := apiGet(server.BaseDomain + "members/" + server.OrgID + "/" + server.ServerAPIKey)
+	if err != nil {
+		return err
+	}
+
+	response, err := parseTeamMembers(body)
+	if err != nil {
+		return err
+	}
+
+	state := teamState{Members: map[string]*teamMemberState{}}
+	if err := readState(stateName, &state); err != nil {
+		return err
+	}
+	if state.Members == nil {
+		state.Members = map[string]*teamMemberState{}
+	}
+
+	// Accounts configured individually, in any profile, are never taken over
+	// by team mode
+	configured := map[string]bool{}
+	for _, profile := range profileNames(viper.GetViper()) {
+		accounts, _ := profileAccounts(viper.GetViper(), profile)
+		for _, account := range accounts {
+			configured[account.Username] = true
+		}
+	}
+
+	// A team user that has since been configured as an account belongs to
+	// the operator, so it must never be locked or deleted below
+	for _, username := range releaseConfiguredAccounts(state.Members, configured) {
+		color.Yellow("Team member %s is now configured as an account, and is no longer managed by team mode.", username)
+	}
+	if err := writeState(stateName, &state); err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, member := range response.Members {
+		if !validUsername.MatchString(member.Username) {
+			color.Red("Skipping team member with invalid username `%s`.", member.Username)
+			continue
+		}
+		if configured[member.Username] {
+			color.Yellow("Skipping team member %s, as the user is configured as an account.", member.Username)
+			continue
+		}
+
+		current[member.Username] = true
+		if err := syncTeamMember(server.Profile, member, state.Members); err != nil {
+			color.Red("Unable to sync team member %s: %s", member.Username, err)
+		}
+
+		// Save after every change, so a failure never forgets a created user
+		if err := writeState(stateName, &state); err != nil {
+			return err
+		}
+	}
+
+	graceDays := defaultTeamGraceDays
+	if key := profileKey(server.Profile, "team.gracedays"); viper.IsSet(key) {
+		graceDays = viper.GetInt(key)
+	}
+	grace := time.Duration(graceDays) * 24 * time.Hour
+
+	maxPercent := defaultTeamMaxLockPercent
+	if key := profileKey(server.Profile, "team.maxlockpercent"); viper.IsSet(key) {
+		maxPercent = viper.GetInt(key)
+	}
+
+	// An outage or a bug in the API can leave members out of the list, so a
+	// sync that would lock too many users at once needs to be confirmed
+	departing, active := teamDepartures(state.Members, current)
+	lockDeparted := confirmDepartures || lockAllowed(departing, active, maxPercent)
+
+	// Lock anyone who has left, and delete them once the grace period is over
+	for username, memberState := range state.Members {
+		if current[username] {
+			continue
+		}
+
+		if memberState.DepartedAt == nil {
+			if !lockDeparted {
+				continue
+			}
+			if err := lockTeamMember(username); err != nil {
+				color.Red("Unable to lock departed team member %s: %s", username, err)
+				continue
+			}
+			now := time.Now()
+			memberState.DepartedAt = &now
+			color.Yellow("Team member %s has left the organisation. The account has been locked.", username)
+		} else if time.Since(*memberState.DepartedAt) >= grace {
+			if err := deleteSystemUser(username); err != nil {
+				color.Red("Unable to delete departed team member %s: %s", username, err)
+				continue
+			}
+			removeSudoers(username)
+			delete(state.Members, username)
+			color.Yellow("The grace period for team member %s has ended. The system user has been deleted.", username)
+		}
+
+		if err := writeState(stateName, &state); err != nil {
+			return err
+		}
+	}
+
+	if !lockDeparted {
+		return fmt.Errorf("%d of the %d team members have left the organisation, more than team.maxlockpercent (%d%%) allows, so none of them have been locked. Run `serverauth sync --confirm-departures` if they have really left", departing, active, maxPercent)
+	}
+
+	return nil
+}
+
+// parseTeamMembers reads the member list returned by the API. A response
+// without a member list is an error rather than an empty team, as it would
+// otherwise lock every team user.
+func parseTeamMembers(body []byte) (*teamMembersResponse, error) {
+	var response teamMembersResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("the member list from the ServerAuth API was invalid: %v", err)
+	}
+	if response.Members == nil {
+		return nil, fmt.Errorf("the ServerAuth API did not return a member list")
+	}
+	return &response, nil
+}
+
+// teamDepartures counts the active team users, and how many of them are no
+// longer current members.
+func teamDepartures(members map[string]*teamMemberState, current map[string]bool) (int, int) {
+	departing, active := 0, 0
+	for username, memberState := range members {
+		if memberState.DepartedAt != nil {
+			continue
+		}
+		active++
+		if !current[username] {
+			departing++
+		}
+	}
+	return departing, active
+}
+
+// lockAllowed reports whether departing of the active team users may be
+// locked without confirmation: never all of them, and no more than
+// maxPercent of them.
+func lockAllowed(departing, active, maxPercent int) bool {
+	if departing == 0 {
+		return true
+	}
+	return departing < active && departing*100 <= active*maxPercent
+}
+
+// releaseConfiguredAccounts forgets the team users that are configured as
+// accounts, and returns their names in order.
+func releaseConfiguredAccounts(members map[string]*teamMemberState, configured map[string]bool) []string {
+	var released []string
+	for username := range members {
+		if configured[username] {
+			delete(members, username)
+			released = append(released, username)
+		}
+	}
+	sort.Strings(released)
+	return released
+}
+
+// syncTeamMember makes sure the system user for a member exists, is
+// unlocked, is in the right groups and has the member's keys.
+func syncTeamMember(profile string, member teamMember, members map[string]*teamMemberState) error {
+	if !validKeysFile(member.Keys) {
+		return fmt.Errorf("the keys returned by the ServerAuth API were invalid")
+	}
+
+	memberState := members[member.Username]
+	// Copied, so members never share the backing array of the groups setting
+	groups := append([]string{}, viper.GetStringSlice(profileKey(profile, "team.groups"))...)
+	groups = append(groups, member.Groups...)
+
+	u, err := user.Lookup(member.Username)
+	if err != nil {
+		if _, ok := err.(user.UnknownUserError); !ok {
+			return err
+		}
+
+		color.Yellow("Creating a system user for team member %s.", member.Username)
+		u, err = createSystemUser(Account{
+			Username: member.Username,
+			Shell:    viper.GetString(profileKey(profile, "team.shell")),
+			Groups:   groups,
+		})
+		if err != nil {
+			return err
+		}
+
+		memberState = &teamMemberState{CreatedAt: time.Now()}
+		members[member.Username] = memberState
+	} else if memberState == nil {
+		return fmt.Errorf("a system user with this name already exists and was not created by ServerAuth")
+	} else {
+		if memberState.DepartedAt != nil {
+			// The member has rejoined during the grace period
+			if err := unexpireSystemUser(member.Username); err != nil {
+				return err
+			}
+			memberState.DepartedAt = nil
+			color.Green("Team member %s has rejoined. The account has been unlocked.", member.Username)
+		}
+
+		if err := setUserGroups(member.Username, groups); err != nil {
+			return err
+		}
+	}
+
+	keysDir, err := openSSHDir(u, true)
+	if err != nil {
+		return err
+	}
+	defer keysDir.Close()
+
+	if _, err := backupKeysFile(keysDir, member.Username, "sync", []byte(member.Keys)); err != nil {
+		return err
+	}
+
+	return keysDir.WriteFile("authorized_keys", []byte(member.Keys), 0600)
+}
+
+// lockTeamMember blocks logins for a departed member and clears their keys.
+func lockTeamMember(username string) error {
+	if err := expireSystemUser(username); err != nil {
+		return err
+	}
+	removeSudoers(username)
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	keysDir, err := openSSHDir(u, false)
+	if err != nil {
+		return err
+	}
+	defer keysDir.Close()
+
+	if _, err := backupKeysFile(keysDir, username, "sync", keysFileTemplate); err != nil {
+		return err
+	}
+
+	return keysDir.WriteFile("authorized_keys", keysFileTemplate, 0600)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A team user that is later configured as an account must be dropped from
+// the team state, or the departed member handling would lock and then
+// delete an account the operator configured on purpose.
+func TestReleaseConfiguredAccounts(t *testing.T) {
+	departed := time.Now().Add(-60 * 24 * time.Hour)
+	members := map[string]*teamMemberState{
+		"alice":  {CreatedAt: departed},
+		"bob":    {CreatedAt: departed, DepartedAt: &departed},
+		"carol":  {CreatedAt: departed},
+		"deploy": {CreatedAt: departed, DepartedAt: &departed},
+	}
+	configured := map[string]bool{"bob": true, "deploy": true, "root": true}
+
+	released := releaseConfiguredAccounts(members, configured)
+
+	if want := []string{"bob", "deploy"}; !reflect.DeepEqual(released, want) {
+		t.Errorf("releaseConfiguredAccounts() = %v, want %v", released, want)
+	}
+	for username := range configured {
+		if _, ok := members[username]; ok {
+			t.Errorf("configured account %s is still managed by team mode", username)
+		}
+	}
+	if len(members) != 2 || members["alice"] == nil || members["carol"] == nil {
+		t.Errorf("team members left = %v, want alice and carol", members)
+	}
+}
+
+func TestParseTeamMembers(t *testing.T) {
+	tests := []struct {
+		body    string
+		members int
+		wantErr bool
+	}{
+		{`{"members": [{"username": "alice", "keys": ""}]}`, 1, false},
+		{`{"members": []}`, 0, false},
+		{`{}`, 0, true},
+		{`{"members": null}`, 0, true},
+		{`{"members": {}}`, 0, true},
+		{`<html>`, 0, true},
+	}
+
+	for _, tt := range tests {
+		response, err := parseTeamMembers([]byte(tt.body))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTeamMembers(%s) error = %v, wantErr %v", tt.body, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(response.Members) != tt.members {
+			t.Errorf("parseTeamMembers(%s) returned %d members, want %d", tt.body, len(response.Members), tt.members)
+		}
+	}
+}
+
+func TestLockAllowed(t *testing.T) {
+	tests := []struct {
+		departing, active, maxPercent int
+		want                          bool
+	}{
+		{0, 0, 50, true},
+		{0, 10, 0, true},
+		{1, 10, 50, true},
+		{5, 10, 50, true},
+		{6, 10, 50, false},
+		{1, 2, 50, true},
+		{1, 1, 100, false},
+		{10, 10, 100, false},
+		{9, 10, 100, true},
+		{1, 10, 0, false},
+	}
+
+	for _, tt := range tests {
+		if got := lockAllowed(tt.departing, tt.active, tt.maxPercent); got != tt.want {
+			t.Errorf("lockAllowed(%d, %d, %d) = %v, want %v", tt.departing, tt.active, tt.maxPercent, got, tt.want)
+		}
+	}
+}
+
+// An API that returns no members, e.g. during an outage, must not lock
+// every team user.
+func TestSyncTeamMembersEmptyResponse(t *testing.T) {
+	for _, body := range []string{`{"members": []}`, `{}`} {
+		t.Run(body, func(t *testing.T) {
+			useTestStateDir(t)
+
+			created := time.Now().Add(-24 * time.Hour)
+			state := teamState{Members: map[string]*teamMemberState{
+				"alice": {CreatedAt: created},
+				"bob":   {CreatedAt: created},
+			}}
+			if err := writeState(teamStateFile, &state); err != nil {
+				t.Fatal(err)
+			}
+
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+			defer api.Close()
+
+			server := serverConfig{Profile: defaultProfile, OrgID: "org", ServerAPIKey: "key", BaseDomain: api.URL + "/"}
+			if err := syncTeamMembers(server); err == nil {
+				t.Error("syncTeamMembers() expected an error")
+			}
+
+			var after teamState
+			if err := readState(teamStateFile, &after); err != nil {
+				t.Fatal(err)
+			}
+			for username, memberState := range after.Members {
+				if memberState.DepartedAt != nil {
+					t.Errorf("team member %s was locked", username)
+				}
+			}
+			if len(after.Members) != 2 {
+				t.Errorf("team members = %v, want alice and bob", after.Members)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// createSystemUser creates the system account described by the given
+// ServerAuth account using useradd. The password is locked, so the account
+// can only be reached with the SSH keys ServerAuth manages.
+func createSystemUser(account Account) (*user.User, error) {
+	args := []string{"--create-home"}
+
+	if len(account.Home) > 0 {
+		args = append(args, "--home-dir", account.Home)
+	}
+	if len(account.Shell) > 0 {
+		args = append(args, "--shell", account.Shell)
+	}
+	if len(account.Group) > 0 {
+		args = append(args, "--gid", account.Group)
+	}
+	if len(account.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(account.Groups, ","))
+	}
+	args = append(args, account.Username)
+
+	if err := runSystemCommand("useradd", args...); err != nil {
+		return nil, err
+	}
+
+	if err := runSystemCommand("usermod", "--lock", account.Username); err != nil {
+		return nil, err
+	}
+
+	return user.Lookup(account.Username)
+}
+
+// deleteSystemUser removes a system account previously created by
+// ServerAuth. The home directory is left in place.
+func deleteSystemUser(username string) error {
+	return runSystemCommand("userdel", username)
+}
+
+// removeCreatedUser deletes a system user that has just been created but
+// couldn't be recorded in the config, as nothing would remove it later.
+func removeCreatedUser(username string) {
+	if err := deleteSystemUser(username); err != nil {
+		color.Red("Unable to remove the system user %s that was just created: %s. Please remove it with userdel.", username, err)
+		return
+	}
+	color.Yellow("The system user %s that was just created has been removed again.", username)
+}
+
+// setUserGroups replaces the supplementary groups of a system user.
+func setUserGroups(username string, groups []string) error {
+	return runSystemCommand("usermod", "--groups", strings.Join(groups, ","), username)
+}
+
+// expireSystemUser expires a system user, which blocks every login
+// including key based SSH logins, without deleting any of its data.
+func expireSystemUser(username string) error {
+	return runSystemCommand("usermod", "--expiredate", "1", username)
+}
+
+// unexpireSystemUser reverses expireSystemUser.
+func unexpireSystemUser(username string) error {
+	return runSystemCommand("usermod", "--expiredate", "", username)
+}
+
+// runSystemCommand runs a system command such as useradd, including its output
+// in the error if it fails.
+func runSystemCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+// The status of a check, from the exit code of its plugin
+const (
+	CheckOK       = "OK"
+	CheckWarning  = "WARNING"
+	CheckCritical = "CRITICAL"
+	CheckUnknown  = "UNKNOWN"
+)
+
+// Check is the result of a Nagios compatible check plugin, or of looking
+// for a watched process
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	// ExitCode is 3, the code for UNKNOWN, when the plugin couldn't be run
+	// or ran out of time
+	ExitCode             int     `json:"exitCode"`
+	Output               string  `json:"output"`
+	DurationMilliseconds float64 `json:"durationMilliseconds"`
+
+	Perfdata []Perfdata `json:"perfdata,omitempty"`
+}
+
+// Perfdata is a single measurement reported by a check plugin
+type Perfdata struct {
+	Label string `json:"label"`
+
+	// Value is left out when the plugin couldn't determine it
+	Value *float64 `json:"value,omitempty"`
+
+	// Unit is one of s, ms, us, %, B, KB, MB, GB, TB or c for a counter,
+	// and is empty for a plain number
+	Unit string `json:"unit,omitempty"`
+
+	// Warning and Critical are the plugin's threshold ranges, e.g. 10, 5:20
+	// or @10:20
+	Warning  string `json:"warning,omitempty"`
+	Critical string `json:"critical,omitempty"`
+
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
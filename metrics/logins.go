@@ -0,0 +1,56 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+import "time"
+
+// The result of a login attempt
+const (
+	LoginAccepted = "accepted"
+	LoginFailed   = "failed"
+)
+
+// LoginEvent is a single SSH login attempt read from the server's logs
+type LoginEvent struct {
+	Time   time.Time `json:"time"`
+	Result string    `json:"result"`
+	User   string    `json:"user"`
+
+	// InvalidUser is set when the user doesn't exist on the server
+	InvalidUser bool `json:"invalidUser,omitempty"`
+
+	SourceIP   string `json:"sourceIp"`
+	SourcePort int    `json:"sourcePort"`
+
+	// Method is how the user authenticated, e.g. publickey, password or
+	// keyboard-interactive/pam
+	Method string `json:"method"`
+
+	// KeyType and KeyFingerprint are only set for public key logins, e.g.
+	// ED25519 and SHA256:... For a certificate the key type ends in -CERT
+	// and the fingerprint is the certificate's key.
+	KeyType        string `json:"keyType,omitempty"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+
+	// PID is the sshd process that handled the login
+	PID int `json:"pid,omitempty"`
+}
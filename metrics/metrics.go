@@ -0,0 +1,110 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package metrics defines the monitoring payload the ServerAuth agent sends
+// to the ServerAuth API. Other tools can use these types to send compatible
+// payloads.
+//
+// Every number carries its unit in its name, e.g. totalBytes or usedPercent.
+// Rates are per second since the previous collection, and are left out until
+// there are two collections to compare.
+package metrics
+
+import "time"
+
+// SchemaVersion is the version of the payload layout described by this
+// package. It changes whenever a field is renamed, removed or changes
+// meaning. Adding a field does not change it.
+const SchemaVersion = 1
+
+// ContentType is the media type of an encoded Payload
+const ContentType = "application/json"
+
+// Payload is a single collection of metrics from a server
+type Payload struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	CollectedAt   time.Time `json:"collectedAt"`
+	Agent         Agent     `json:"agent"`
+	Host          Host      `json:"host"`
+
+	System       *System       `json:"system,omitempty"`
+	Time         *Time         `json:"time,omitempty"`
+	CPU          *CPU          `json:"cpu,omitempty"`
+	Memory       *Memory       `json:"memory,omitempty"`
+	Load         *Load         `json:"load,omitempty"`
+	Processes    *Processes    `json:"processes,omitempty"`
+	TopProcesses *TopProcesses `json:"topProcesses,omitempty"`
+	Filesystems  []Filesystem  `json:"filesystems,omitempty"`
+	DiskIO       []DiskIO      `json:"diskIO,omitempty"`
+	Network      *Network      `json:"network,omitempty"`
+	Checks       []Check       `json:"checks,omitempty"`
+	Services     []Service     `json:"services,omitempty"`
+	Logins       []LoginEvent  `json:"logins,omitempty"`
+
+	// Errors holds the problem with every group of metrics that couldn't be
+	// collected, keyed by the name of the collector. A group may still be
+	// partly filled in when its collector fails.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// New returns an empty payload for the current schema version, collected at
+// the given time.
+func New(collectedAt time.Time) *Payload {
+	return &Payload{
+		SchemaVersion: SchemaVersion,
+		CollectedAt:   collectedAt,
+	}
+}
+
+// Agent identifies the software that collected the payload
+type Agent struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Host identifies the server the payload was collected from
+type Host struct {
+	Hostname string `json:"hostname"`
+
+	// ID is a stable identifier for the machine, e.g. /etc/machine-id, which
+	// survives the hostname changing
+	ID string `json:"id,omitempty"`
+
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// System describes the operating system and how long it has been running
+type System struct {
+	Platform        string `json:"platform"`
+	PlatformFamily  string `json:"platformFamily"`
+	PlatformVersion string `json:"platformVersion"`
+	KernelVersion   string `json:"kernelVersion"`
+	UptimeSeconds   uint64 `json:"uptimeSeconds"`
+}
+
+// Time is the server's local time zone
+type Time struct {
+	// Timezone is the abbreviated time zone name, e.g. BST
+	Timezone         string `json:"timezone"`
+	UTCOffsetSeconds int    `json:"utcOffsetSeconds"`
+}
@@ -0,0 +1,52 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+import "time"
+
+// TopProcesses are the processes using the most CPU and the most memory
+type TopProcesses struct {
+	ByCPU    []Process `json:"byCpu"`
+	ByMemory []Process `json:"byMemory"`
+}
+
+// Process is a single running process
+type Process struct {
+	PID  int32  `json:"pid"`
+	User string `json:"user"`
+	Name string `json:"name"`
+
+	// Command is the full command line, with anything that looks like a
+	// password or token replaced by [redacted]. Kernel threads have no
+	// command line, so their name is shown in brackets, as ps does.
+	Command string `json:"command"`
+
+	RSSBytes      uint64  `json:"rssBytes"`
+	MemoryPercent float64 `json:"memoryPercent"`
+
+	// CPUPercent is the share of a single core used since the previous
+	// collection, or since the process started if that was later. A process
+	// busy on several cores can use more than 100%.
+	CPUPercent float64 `json:"cpuPercent"`
+
+	StartedAt time.Time `json:"startedAt"`
+}
@@ -0,0 +1,51 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+import "time"
+
+// Service is the state of a systemd unit
+type Service struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	// LoadState is not-found for a unit that doesn't exist
+	LoadState string `json:"loadState"`
+
+	// ActiveState is e.g. active, inactive or failed, and SubState the unit
+	// type's own state, e.g. running or exited for a service
+	ActiveState string `json:"activeState"`
+	SubState    string `json:"subState"`
+
+	// Result is how a service last finished, e.g. success or exit-code.
+	// Units other than services don't have one.
+	Result string `json:"result,omitempty"`
+
+	// Restarts counts the times systemd has restarted a service after it
+	// failed, and needs systemd 235 or later
+	Restarts uint32 `json:"restarts"`
+
+	// StateChangedAt and SecondsInState are left out when the unit hasn't
+	// changed state since the server started
+	StateChangedAt *time.Time `json:"stateChangedAt,omitempty"`
+	SecondsInState uint64     `json:"secondsInState,omitempty"`
+}
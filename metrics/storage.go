@@ -0,0 +1,85 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+// Filesystem is the usage of a single mounted filesystem
+type Filesystem struct {
+	Mountpoint  string  `json:"mountpoint"`
+	Device      string  `json:"device"`
+	FSType      string  `json:"fstype"`
+	TotalBytes  uint64  `json:"totalBytes"`
+	UsedBytes   uint64  `json:"usedBytes"`
+	FreeBytes   uint64  `json:"freeBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+	InodesTotal uint64  `json:"inodesTotal"`
+	InodesUsed  uint64  `json:"inodesUsed"`
+	InodesFree  uint64  `json:"inodesFree"`
+
+	// Error is why the usage couldn't be read, e.g. a hung network mount.
+	// The usage fields are all zero when it is set.
+	Error string `json:"error,omitempty"`
+}
+
+// DiskIO is the activity of a single block device since the previous
+// collection
+type DiskIO struct {
+	Device                   string  `json:"device"`
+	ReadOpsPerSecond         float64 `json:"readOpsPerSecond"`
+	WriteOpsPerSecond        float64 `json:"writeOpsPerSecond"`
+	ReadBytesPerSecond       float64 `json:"readBytesPerSecond"`
+	WriteBytesPerSecond      float64 `json:"writeBytesPerSecond"`
+	ReadLatencyMilliseconds  float64 `json:"readLatencyMilliseconds"`
+	WriteLatencyMilliseconds float64 `json:"writeLatencyMilliseconds"`
+	UtilisationPercent       float64 `json:"utilisationPercent"`
+}
+
+// Network holds every network interface and the state of TCP connections
+type Network struct {
+	Interfaces []Interface `json:"interfaces"`
+
+	// TCPConnections counts TCP connections by state, e.g. ESTABLISHED
+	TCPConnections map[string]int `json:"tcpConnections"`
+	SSHSessions    int            `json:"sshSessions"`
+}
+
+// Interface is the addresses and traffic of a single network interface
+type Interface struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+
+	// Traffic is left out when there was no previous collection to compare
+	// with
+	Traffic *InterfaceTraffic `json:"traffic,omitempty"`
+}
+
+// InterfaceTraffic is the traffic on an interface since the previous
+// collection
+type InterfaceTraffic struct {
+	BytesInPerSecond    float64 `json:"bytesInPerSecond"`
+	BytesOutPerSecond   float64 `json:"bytesOutPerSecond"`
+	PacketsInPerSecond  float64 `json:"packetsInPerSecond"`
+	PacketsOutPerSecond float64 `json:"packetsOutPerSecond"`
+	ErrorsInPerSecond   float64 `json:"errorsInPerSecond"`
+	ErrorsOutPerSecond  float64 `json:"errorsOutPerSecond"`
+	DropsInPerSecond    float64 `json:"dropsInPerSecond"`
+	DropsOutPerSecond   float64 `json:"dropsOutPerSecond"`
+}
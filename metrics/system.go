@@ -0,0 +1,108 @@
+/*
+Copyright © 2019 ServerAuth.com <info@serverauth.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package metrics
+
+// CPU describes the processors and how busy they have been
+type CPU struct {
+	Model   string `json:"model"`
+	Cores   int    `json:"cores"`
+	Threads int    `json:"threads"`
+
+	// Usage and PerCore are left out when there was no previous collection
+	// to compare with, e.g. on the first run or after a reboot
+	Usage   *CPUUsage  `json:"usage,omitempty"`
+	PerCore []CPUUsage `json:"perCore,omitempty"`
+}
+
+// CPUUsage is the share of CPU time spent in each state. Used is everything
+// except idle and iowait.
+type CPUUsage struct {
+	UsedPercent   float64 `json:"usedPercent"`
+	UserPercent   float64 `json:"userPercent"`
+	SystemPercent float64 `json:"systemPercent"`
+	IOWaitPercent float64 `json:"iowaitPercent"`
+	StealPercent  float64 `json:"stealPercent"`
+	IdlePercent   float64 `json:"idlePercent"`
+}
+
+// Memory is a breakdown of memory and swap use
+type Memory struct {
+	TotalBytes     uint64  `json:"totalBytes"`
+	AvailableBytes uint64  `json:"availableBytes"`
+	UsedBytes      uint64  `json:"usedBytes"`
+	FreeBytes      uint64  `json:"freeBytes"`
+	UsedPercent    float64 `json:"usedPercent"`
+	BuffersBytes   uint64  `json:"buffersBytes"`
+	CachedBytes    uint64  `json:"cachedBytes"`
+
+	Swap      Swap      `json:"swap"`
+	HugePages HugePages `json:"hugePages"`
+
+	// Pressure is keyed by resource (cpu, memory or io), and is left out
+	// when the kernel doesn't support pressure stall information
+	Pressure map[string]Pressure `json:"pressure,omitempty"`
+}
+
+// Swap is the use of swap space
+type Swap struct {
+	TotalBytes  uint64  `json:"totalBytes"`
+	UsedBytes   uint64  `json:"usedBytes"`
+	FreeBytes   uint64  `json:"freeBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// HugePages is the use of the huge page pool
+type HugePages struct {
+	Total     uint64 `json:"total"`
+	Free      uint64 `json:"free"`
+	SizeBytes uint64 `json:"sizeBytes"`
+}
+
+// Pressure is the pressure on a single resource. Some is the time at least
+// one task was stalled, Full the time every task was. Full is left out when
+// the kernel doesn't report it.
+type Pressure struct {
+	Some PressureAverages  `json:"some"`
+	Full *PressureAverages `json:"full,omitempty"`
+}
+
+// PressureAverages is the share of time tasks were stalled waiting for a
+// resource, averaged over 10, 60 and 300 seconds
+type PressureAverages struct {
+	Avg10Percent  float64 `json:"avg10Percent"`
+	Avg60Percent  float64 `json:"avg60Percent"`
+	Avg300Percent float64 `json:"avg300Percent"`
+}
+
+// Load is the system load average over 1, 5 and 15 minutes
+type Load struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// Processes counts processes by state
+type Processes struct {
+	Running int `json:"running"`
+	Blocked int `json:"blocked"`
+	Total   int `json:"total"`
+}